@@ -1,10 +1,12 @@
 package cli
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +20,8 @@ var (
 	clientStartCmd    = flag.NewFlagSet("start", flag.ExitOnError)
 	clientRegisterCmd = flag.NewFlagSet("register", flag.ExitOnError)
 	clientLoginCmd    = flag.NewFlagSet("login", flag.ExitOnError)
+	clientReserveCmd  = flag.NewFlagSet("reserve", flag.ExitOnError)
+	clientReleaseCmd  = flag.NewFlagSet("release", flag.ExitOnError)
 
 	// server
 	serverStartCmd = flag.NewFlagSet("start", flag.ExitOnError)
@@ -30,9 +34,27 @@ func RunCommand() {
 	}
 
 	// client start
-	protocol := clientStartCmd.String("protocol", "http", "Protocol to use for the tunnel. Valid options are 'http', 'https', 'tcp', 'tls'")
+	protocol := clientStartCmd.String("protocol", "http", "Protocol to use for the tunnel. Valid options are 'http', 'https', 'tcp', 'tcps', 'udp'")
 	port := clientStartCmd.Int("port", 80, "Local port from which traffic will be tunneled to")
-	subdomain := clientStartCmd.String("subdomain", "one", "External subdomain to bind service on")
+	subdomain := clientStartCmd.String("subdomain", "", "External subdomain to bind service on, a random one is picked when empty")
+	hostname := clientStartCmd.String("hostname", "", "Custom domain to bind service on, it must have a CNAME pointing at the server")
+	proxyProtocol := clientStartCmd.String("proxyProtocol", "", "Send a PROXY protocol header with the real client address to the local service. Valid options are 'v1', 'v2'")
+	forwardedHeaders := clientStartCmd.Bool("forwardedHeaders", false, "Add X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers to http requests")
+	http2 := clientStartCmd.Bool("http2", false, "Offer HTTP/2 to public clients, the local service has to speak HTTP/2 as well")
+	basicAuth := &stringList{}
+	clientStartCmd.Var(basicAuth, "basic-auth", "Require http basic auth as user:pass, repeat to allow several users")
+	clientStartCmd.Var(basicAuth, "basicAuth", "Same as --basic-auth")
+	allow := &stringList{}
+	clientStartCmd.Var(allow, "allow", "Only let public peers from this cidr or ip through, can be repeated")
+	deny := &stringList{}
+	clientStartCmd.Var(deny, "deny", "Refuse public peers from this cidr or ip, can be repeated and wins over allow")
+	hostHeader := clientStartCmd.String("host-header", client.HostHeaderPreserve, "Host header sent to the local service. Valid options are 'preserve', 'rewrite' (localhost:<port>) or any host")
+	clientStartCmd.StringVar(hostHeader, "hostHeader", client.HostHeaderPreserve, "Same as --host-header")
+	rewriteOrigin := clientStartCmd.Bool("rewriteOrigin", false, "Rewrite Origin and Referer along with the host header")
+	routes := &stringList{}
+	clientStartCmd.Var(routes, "route", "Send requests under a path prefix to another local port as /prefix=port, can be repeated")
+	maxConns := clientStartCmd.Uint("maxConns", 0, "Most connections the tunnel keeps open at once, 0 takes the server's limit")
+	group := clientStartCmd.Bool("group", false, "Share the subdomain with other clients using the same token, traffic is load balanced between them")
 	clientStartServerUrl := clientStartCmd.String("serverUrl", "harlot.app:8050", "Server url to connect to")
 
 	// client register
@@ -42,6 +64,46 @@ func RunCommand() {
 	token := clientLoginCmd.String("token", "===", "The auth token obtained from eginstration")
 	loginServerUrl := clientLoginCmd.String("serverUrl", "harlot.app:8050", "Server to authenticate with")
 
+	// client reserve
+	reserveSubdomain := clientReserveCmd.String("subdomain", "", "Subdomain to keep for your token")
+	reserveServerUrl := clientReserveCmd.String("serverUrl", "harlot.app:8050", "Server to reserve the subdomain on")
+
+	// client release
+	releaseSubdomain := clientReleaseCmd.String("subdomain", "", "Reserved subdomain to give up")
+	releaseServerUrl := clientReleaseCmd.String("serverUrl", "harlot.app:8050", "Server to release the subdomain on")
+
+	// server start
+	httpPort := serverStartCmd.Int("httpPort", 80, "Port for the public plain http server")
+	domain := serverStartCmd.String("domain", server.MainConfig.BaseDomain, "Base domain tunnels get their subdomains under")
+	blockedSubdomains := serverStartCmd.String("blockedSubdomains", "", "Comma separated subdomains nobody may use, replaces the built in list of service names such as www, admin and api")
+	blockedWords := serverStartCmd.String("blockedWords", "", "Comma separated words no subdomain may contain between hyphens, replaces the built in list of profanity")
+	tlsMode := serverStartCmd.String("tlsMode", string(server.PassthroughTlsMode), "Where public tls is terminated. Valid options are 'passthrough' (on the client) and 'edge' (on the server)")
+	certFile := serverStartCmd.String("certFile", server.MainConfig.CertFile, "Certificate used by the server, a wildcard for the base domain in edge mode")
+	keyFile := serverStartCmd.String("keyFile", server.MainConfig.KeyFile, "Private key of the server certificate")
+	useAcme := serverStartCmd.Bool("acme", false, "Issue certificates automatically over acme (http-01 / tls-alpn-01 challenges) for the base domain, acmeHosts and, in edge mode, tunnels. In passthrough mode clients keep terminating tunnels with their own certificate")
+	acmeDirectory := serverStartCmd.String("acmeDirectory", server.MainConfig.AcmeDirectoryURL, "Acme directory url, e.g. a local pebble instance")
+	acmeCacheDir := serverStartCmd.String("acmeCacheDir", server.MainConfig.AcmeCacheDir, "Directory where issued certificates are cached")
+	acmeEmail := serverStartCmd.String("acmeEmail", "", "Contact email for the acme account")
+	acmeCaFile := serverStartCmd.String("acmeCaFile", "", "Extra ca used to trust the acme directory")
+	acmeHosts := serverStartCmd.String("acmeHosts", "", "Comma separated hostnames of the server itself that always get a certificate besides the base domain")
+	loadBalancing := serverStartCmd.String("loadBalancing", string(server.MainConfig.LoadBalancing), "How a group of clients sharing a subdomain is picked. Valid options are 'roundrobin', 'leastconn'")
+	udpIdleTimeout := serverStartCmd.Duration("udpIdleTimeout", server.MainConfig.UdpIdleTimeout, "How long a quiet udp peer keeps its flow open")
+	errorPageFormat := serverStartCmd.String("errorPageFormat", string(server.MainConfig.ErrorPageFormat), "Format of the page served when a tunnel is missing or offline. Valid options are 'html' (json when asked for in Accept) and 'json'")
+	errorPageTemplate := serverStartCmd.String("errorPageTemplate", "", "Html template file replacing the built in error page")
+	ipRateLimit := serverStartCmd.Float64("ipRateLimit", 0, "New connections and http requests per second a single ip may make to a tunnel, 0 disables the limit")
+	tunnelRateLimit := serverStartCmd.Float64("tunnelRateLimit", 0, "New connections and http requests per second a tunnel accepts, 0 disables the limit")
+	tokenRateLimit := serverStartCmd.Float64("tokenRateLimit", 0, "New connections and http requests per second shared by all tunnels of a token, 0 disables the limit")
+	bandwidthUp := serverStartCmd.String("bandwidthUp", "0", "Bytes per second a token may send to its tunnels, e.g. 10MB, 0 disables shaping")
+	bandwidthDown := serverStartCmd.String("bandwidthDown", "0", "Bytes per second a token's tunnels may send back, e.g. 10MB, 0 disables shaping")
+	monthlyQuota := serverStartCmd.String("monthlyQuota", "0", "Bytes a token may transfer per month, e.g. 100GB, 0 is unlimited")
+	tokenQuotas := &stringList{}
+	serverStartCmd.Var(tokenQuotas, "tokenQuota", "Monthly transfer quota of a single token as token=size, e.g. <token>=10GB, overrides monthlyQuota and can be repeated")
+	serverMaxConns := serverStartCmd.Int("maxConns", server.MainConfig.MaxConns, "Most connections a tunnel may have open at once, clients can only ask for less")
+	connQueueSize := serverStartCmd.Int("connQueueSize", server.MainConfig.ConnQueueSize, "Public connections that may wait for a tunnel at its connection limit")
+	connQueueTimeout := serverStartCmd.Duration("connQueueTimeout", server.MainConfig.ConnQueueTimeout, "How long a public connection waits for a tunnel before giving up")
+	reconnectGrace := serverStartCmd.Duration("reconnectGrace", server.MainConfig.ReconnectGrace, "How long a tunnel whose client dropped keeps its subdomain and port for that client, 0 frees them right away")
+	tcpPorts := serverStartCmd.String("tcpPorts", fmt.Sprintf("%d-%d", server.DefaultTcpPortRangeStart, server.DefaultTcpPortRangeEnd), "Range of public ports handed out to tcp and udp tunnels")
+
 	if len(os.Args) < 3 {
 		PrintHelp()
 		os.Exit(1)
@@ -56,9 +118,66 @@ func RunCommand() {
 		case "login":
 			clientLoginCmd.Parse(os.Args[3:])
 			HandleClientLoginCommand(*loginServerUrl, *token)
+		case "reserve":
+			clientReserveCmd.Parse(os.Args[3:])
+			HandleClientReserveCommand(*reserveServerUrl, *reserveSubdomain)
+		case "release":
+			clientReleaseCmd.Parse(os.Args[3:])
+			HandleClientReleaseCommand(*releaseServerUrl, *releaseSubdomain)
 		case "start":
 			clientStartCmd.Parse(os.Args[3:])
-			HandleClientStartCommand(*protocol, *port, *subdomain, *clientStartServerUrl)
+			proxyProtocolVersion, err := client.ParseProxyProtocol(*proxyProtocol)
+			if err != nil {
+				utils.LogError(err.Error())
+				PrintHelp()
+				os.Exit(1)
+			}
+
+			basicAuthUsers, err := client.ParseBasicAuth(*basicAuth)
+			if err != nil {
+				utils.LogError(err.Error())
+				PrintHelp()
+				os.Exit(1)
+			}
+
+			serviceRoutes, err := client.ParseRoutes(*routes)
+			if err != nil {
+				utils.LogError(err.Error())
+				PrintHelp()
+				os.Exit(1)
+			}
+
+			_, err = server.ParseIpRules(*allow, *deny)
+			if err != nil {
+				utils.LogError(err.Error())
+				PrintHelp()
+				os.Exit(1)
+			}
+
+			tunnelReq := &server.TunnelRequest{
+				Subdomain:   *subdomain,
+				Hostname:    *hostname,
+				ForwardAddr: proxyProtocolVersion != client.NoProxyProtocol || *forwardedHeaders,
+				Group:       *group,
+				Allow:       *allow,
+				Deny:        *deny,
+				MaxConns:    uint32(*maxConns),
+			}
+
+			service := &client.Service{
+				Protocol:         *protocol,
+				IsTls:            strings.HasSuffix(*protocol, "s"),
+				Port:             *port,
+				ProxyProtocol:    proxyProtocolVersion,
+				ForwardedHeaders: *forwardedHeaders,
+				Http2:            *http2,
+				BasicAuth:        basicAuthUsers,
+				HostHeader:       *hostHeader,
+				RewriteOrigin:    *rewriteOrigin,
+				Routes:           serviceRoutes,
+			}
+
+			HandleClientStartCommand(service, tunnelReq, *clientStartServerUrl)
 		default:
 			PrintHelp()
 			os.Exit(1)
@@ -67,7 +186,37 @@ func RunCommand() {
 		switch os.Args[2] {
 		case "start":
 			serverStartCmd.Parse(os.Args[3:])
-			HandleServerStartCommand()
+			server.MainConfig.BaseDomain = server.NormalizeHostname(*domain)
+			if *blockedSubdomains != "" {
+				server.MainConfig.BlockedSubdomains = splitList(strings.ToLower(*blockedSubdomains))
+			}
+			if *blockedWords != "" {
+				server.MainConfig.BlockedWords = splitList(strings.ToLower(*blockedWords))
+			}
+			server.MainConfig.TlsMode = server.TlsMode(*tlsMode)
+			server.MainConfig.CertFile = *certFile
+			server.MainConfig.KeyFile = *keyFile
+			server.MainConfig.AcmeDirectoryURL = *acmeDirectory
+			server.MainConfig.AcmeCacheDir = *acmeCacheDir
+			server.MainConfig.AcmeEmail = *acmeEmail
+			server.MainConfig.AcmeCAFile = *acmeCaFile
+			server.MainConfig.AcmeHosts = splitList(*acmeHosts)
+			server.MainConfig.LoadBalancing = server.LoadBalancing(*loadBalancing)
+			server.MainConfig.UdpIdleTimeout = *udpIdleTimeout
+			server.MainConfig.MaxConns = *serverMaxConns
+			server.MainConfig.ConnQueueSize = *connQueueSize
+			server.MainConfig.ConnQueueTimeout = *connQueueTimeout
+			server.MainConfig.ReconnectGrace = *reconnectGrace
+			server.MainConfig.ErrorPageFormat = server.ErrorPageFormat(*errorPageFormat)
+			server.MainRateLimits = server.NewRateLimits(*ipRateLimit, *tunnelRateLimit, *tokenRateLimit)
+			err := configureBandwidth(*bandwidthUp, *bandwidthDown, *monthlyQuota, *tokenQuotas)
+			if err != nil {
+				utils.LogError(err.Error())
+				PrintHelp()
+				os.Exit(1)
+			}
+
+			HandleServerStartCommand(*httpPort, *tcpPorts, *useAcme, *errorPageTemplate)
 		default:
 			PrintHelp()
 			os.Exit(1)
@@ -90,6 +239,8 @@ Available Commands:
   client register       Registers the client with the Harlot server to obtain a token.
   client start          Starts a tunnel for specified protocol and port.
   client login          Logs the client into the harlot server using the provided token.
+  client reserve        Reserves a subdomain for your token.
+  client release        Releases a subdomain reserved for your token.
   server start          Starts the tunnel server.
 
 Use "harlot help [command]" for more information about a command.
@@ -98,10 +249,7 @@ Use "harlot help [command]" for more information about a command.
 
 func HandleClientRegisterCommand(serverUrl string) {
 	utils.LogInfo("Connecting to harlot server...")
-	client, err := client.NewClient(serverUrl)
-	if err != nil {
-		panic(utils.LogErrorReturn("Failed to create client %w", err))
-	}
+	client := dialServer(serverUrl)
 
 	token, err := client.Register()
 	if err != nil {
@@ -117,20 +265,56 @@ var validProtocols = map[string]string{
 	"https": "https",
 	"tcp":   "tcp",
 	"tcps":  "tcps",
+	"udp":   "udp",
 }
 
-func HandleClientStartCommand(protocol string, port int, subdomain string, serverUrl string) {
+// httpOnlyFlags lists the flags given that only mean something to http
+// tunnels
+func httpOnlyFlags(service *client.Service) []string {
+	flags := []string{}
+	if len(service.BasicAuth) > 0 {
+		flags = append(flags, "--basic-auth")
+	}
+
+	if len(service.Routes) > 0 {
+		flags = append(flags, "--route")
+	}
+
+	if service.HostHeader != client.HostHeaderPreserve {
+		flags = append(flags, "--host-header")
+	}
+
+	if service.RewriteOrigin {
+		flags = append(flags, "--rewriteOrigin")
+	}
+
+	if service.ForwardedHeaders {
+		flags = append(flags, "--forwardedHeaders")
+	}
+
+	return flags
+}
+
+func HandleClientStartCommand(service *client.Service, tunnelReq *server.TunnelRequest, serverUrl string) {
 	// validate protocol
-	if _, ok := validProtocols[protocol]; !ok {
+	if _, ok := validProtocols[service.Protocol]; !ok {
 		PrintHelp()
 		return
 	}
 
-	cl, err := client.NewClient(serverUrl)
-	if err != nil {
-		panic(utils.LogErrorReturn("Failed to create client %w", err))
+	if flags := httpOnlyFlags(service); len(flags) > 0 && !server.IsHttpProtocol(service.Protocol) {
+		utils.LogError("Flags only work for http and https tunnels", slog.String("flags", strings.Join(flags, " ")))
+		PrintHelp()
+		return
 	}
 
+	if tunnelReq.Hostname != "" && server.HasOwnPort(service.Protocol) {
+		utils.LogError("Hostnames only work for http and https tunnels, tcp and udp tunnels get their own port")
+		PrintHelp()
+		return
+	}
+
+	cl := dialServer(serverUrl)
 	token, err := client.GetTokenFromConfig()
 	if err != nil {
 		panic(utils.LogErrorReturn("Failed to create client %v", err))
@@ -146,21 +330,14 @@ func HandleClientStartCommand(protocol string, port int, subdomain string, serve
 		return
 	}
 
-	cl, err = cl.FromOld()
-	if err != nil {
-		panic(utils.LogErrorReturn("Failed to create client %w", err))
-	}
-
-	cl.Tunnel(serverUrl, token, subdomain, protocol, strings.HasSuffix(protocol, "s"), port)
+	cl = dialServer(serverUrl)
+	cl.Tunnel(serverUrl, token, tunnelReq, service)
 }
 
 func HandleClientLoginCommand(serverUrl, token string) {
 	utils.LogInfo("Connecting to harlot server...")
 
-	cl, err := client.NewClient(serverUrl)
-	if err != nil {
-		panic(utils.LogErrorReturn("Failed to create client %w", err))
-	}
+	cl := dialServer(serverUrl)
 
 	utils.LogInfo("Authenticating with server...")
 	ok, err := cl.Login(serverUrl, token)
@@ -177,15 +354,144 @@ func HandleClientLoginCommand(serverUrl, token string) {
 	utils.LogInfo("Successfully authenticated with server")
 }
 
-func HandleServerStartCommand() {
+func HandleClientReserveCommand(serverUrl, subdomain string) {
+	if subdomain == "" {
+		utils.LogError("Provide the subdomain to reserve")
+		return
+	}
+
+	cl, token := connectWithToken(serverUrl)
+	code, err := cl.Reserve(token, subdomain)
+	if err != nil {
+		return
+	}
+
+	if code != server.NoErrorCode {
+		utils.LogError("Could not reserve subdomain", slog.String("subdomain", subdomain), slog.String("reason", code.String()))
+		return
+	}
+
+	utils.LogInfo("Subdomain reserved", slog.String("subdomain", subdomain))
+}
+
+func HandleClientReleaseCommand(serverUrl, subdomain string) {
+	if subdomain == "" {
+		utils.LogError("Provide the subdomain to release")
+		return
+	}
+
+	cl, token := connectWithToken(serverUrl)
+	code, err := cl.Release(token, subdomain)
+	if err != nil {
+		return
+	}
+
+	if code != server.NoErrorCode {
+		utils.LogError("Could not release subdomain", slog.String("subdomain", subdomain), slog.String("reason", code.String()))
+		return
+	}
+
+	utils.LogInfo("Subdomain released", slog.String("subdomain", subdomain))
+}
+
+// connectWithToken opens a connection to the server with the token saved by
+// the login command
+func connectWithToken(serverUrl string) (*client.Client, string) {
+	cl := dialServer(serverUrl)
+	token, err := client.GetTokenFromConfig()
+	if err != nil {
+		panic(utils.LogErrorReturn("Failed to read token, login first %v", err))
+	}
+
+	return cl, token
+}
+
+// dialServer connects to the server, a failed hello is reported plainly as
+// it only means one side needs upgrading
+func dialServer(serverUrl string) *client.Client {
+	cl, err := client.NewClient(serverUrl)
+	if errors.Is(err, server.IncompatibleProtocolError) {
+		utils.LogError(err.Error(), slog.String("clientVersion", server.Version))
+		os.Exit(1)
+	}
+
+	if err != nil {
+		panic(utils.LogErrorReturn("Failed to create client %w", err))
+	}
+
+	return cl
+}
+
+func HandleServerStartCommand(httpServerPort int, tcpPorts string, useAcme bool, errorPageTemplate string) {
+	tcpPortStart, tcpPortEnd, err := parsePortRange(tcpPorts)
+	if err != nil {
+		panic(utils.LogErrorReturn("Invalid tcp port range %v", err))
+	}
+
+	server.MainPortAllocator = server.NewPortAllocator(tcpPortStart, tcpPortEnd)
+
+	if useAcme {
+		server.MainCertManager, err = server.NewCertManager(server.MainConfig)
+		if err != nil {
+			panic(utils.LogErrorReturn("Failed to create acme manager %v", err))
+		}
+
+		if server.MainConfig.TlsMode == server.PassthroughTlsMode {
+			utils.LogInfo("Acme only covers the server's own hosts in passthrough mode, use edge mode for tunnel certificates")
+		}
+	}
+
+	switch server.MainConfig.LoadBalancing {
+	case server.RoundRobinLoadBalancing, server.LeastConnLoadBalancing:
+	default:
+		panic(utils.LogErrorReturn("Invalid load balancing %v", server.MainConfig.LoadBalancing))
+	}
+
+	switch server.MainConfig.TlsMode {
+	case server.PassthroughTlsMode, server.EdgeTlsMode:
+	default:
+		panic(utils.LogErrorReturn("Invalid tls mode %v", server.MainConfig.TlsMode))
+	}
+
+	server.MainConfig.PublicTlsConfig, err = server.GetServerTlsConfig()
+	if err != nil {
+		panic(utils.LogErrorReturn("Failed to load public certificate %v", err))
+	}
+
+	if server.MainConfig.MaxConns < 1 {
+		panic(utils.LogErrorReturn("Invalid max conns %v", server.MainConfig.MaxConns))
+	}
+
+	if server.MainConfig.UdpIdleTimeout < server.MinUdpIdleTimeout {
+		panic(utils.LogErrorReturn("Invalid udp idle timeout %v, it must be at least %v", server.MainConfig.UdpIdleTimeout, server.MinUdpIdleTimeout))
+	}
+
+	switch server.MainConfig.ErrorPageFormat {
+	case server.HtmlErrorPageFormat, server.JsonErrorPageFormat:
+	default:
+		panic(utils.LogErrorReturn("Invalid error page format %v", server.MainConfig.ErrorPageFormat))
+	}
+
+	if errorPageTemplate != "" {
+		err = server.LoadErrorPageTemplate(errorPageTemplate)
+		if err != nil {
+			panic(utils.LogErrorReturn("Failed to load error page template %v", err))
+		}
+	}
+
 	go func() {
 		server.MainConnectionPooler.StartPrunner()
 	}()
 
+	go func() {
+		server.MainRateLimits.StartPrunner()
+	}()
+
 	privateServerPort := 8050
 	publicServerPort := 443
 
 	utils.LogInfo(fmt.Sprintf("Starting public server on : %d", publicServerPort))
+	utils.LogInfo(fmt.Sprintf("Starting public http server on : %d", httpServerPort))
 	utils.LogInfo(fmt.Sprintf("Starting private server on : %d", privateServerPort))
 
 	privateServer, err := server.CreateTlsServer(
@@ -214,6 +520,19 @@ func HandleServerStartCommand() {
 		publicServer.Start()
 	}()
 
+	httpServer, err := server.CreatePlainServer(
+		httpServerPort,
+		server.HttpServerHandler,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		httpServer.Start()
+	}()
+
 	for {
 		time.Sleep(1 * time.Second)
 		select {
@@ -221,7 +540,124 @@ func HandleServerStartCommand() {
 			return
 		case <-publicServer.Done:
 			return
+		case <-httpServer.Done:
+			return
 		default:
 		}
 	}
 }
+
+func parsePortRange(portRange string) (int, int, error) {
+	parts := strings.Split(portRange, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected start-end, got %q", portRange)
+	}
+
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %q", portRange)
+	}
+
+	return start, end, nil
+}
+
+func configureBandwidth(up, down, quota string, tokenQuotas []string) error {
+	upBytes, err := parseByteSize(up)
+	if err != nil {
+		return err
+	}
+
+	downBytes, err := parseByteSize(down)
+	if err != nil {
+		return err
+	}
+
+	quotaBytes, err := parseByteSize(quota)
+	if err != nil {
+		return err
+	}
+
+	server.MainTrafficShaper = server.NewTrafficShaper(upBytes, downBytes)
+	server.MainConfig.MonthlyQuota = quotaBytes
+
+	for _, value := range tokenQuotas {
+		// tokens are base64 and may end in = themselves
+		split := strings.LastIndex(value, "=")
+		if split <= 0 {
+			return fmt.Errorf("invalid token quota %q, expected token=size", value)
+		}
+
+		tokenQuota, err := parseByteSize(value[split+1:])
+		if err != nil {
+			return err
+		}
+
+		err = server.MainTokenStore.SetMonthlyQuota(value[:split], tokenQuota)
+		if err != nil {
+			return fmt.Errorf("invalid token quota %q: %w", value, err)
+		}
+	}
+
+	return nil
+}
+
+// parseByteSize reads sizes such as 512, 64KB, 10MB or 1.5GB, units are
+// powers of 1024
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range units {
+		if trimmed, found := strings.CutSuffix(number, unit.suffix); found {
+			number = strings.TrimSpace(trimmed)
+			multiplier = unit.size
+			break
+		}
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return int64(size * multiplier), nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// stringList collects every value of a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
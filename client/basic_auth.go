@@ -0,0 +1,69 @@
+package client
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const BasicAuthRealm = "harlot"
+
+// BasicAuthUser is one set of credentials allowed through the tunnel
+type BasicAuthUser struct {
+	Username string
+	Password string
+}
+
+// ParseBasicAuth turns the repeated user:pass cli values into users
+func ParseBasicAuth(values []string) ([]BasicAuthUser, error) {
+	users := []BasicAuthUser{}
+	for _, value := range values {
+		username, password, found := strings.Cut(value, ":")
+		if !found || username == "" || password == "" {
+			return nil, fmt.Errorf("invalid basic auth %q, expected user:pass", value)
+		}
+
+		users = append(users, BasicAuthUser{Username: username, Password: password})
+	}
+
+	return users, nil
+}
+
+// isAuthorized checks the request's credentials against every user, the
+// comparisons are constant time and never stop early
+func isAuthorized(req *http.Request, users []BasicAuthUser) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	authorized := 0
+	for _, user := range users {
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(user.Username))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(user.Password))
+		authorized |= usernameMatch & passwordMatch
+	}
+
+	return authorized == 1
+}
+
+// newUnauthorizedResponse asks the browser for credentials, the connection
+// is closed since the request body was never read
+func newUnauthorizedResponse(req *http.Request) *http.Response {
+	body := "Unauthorized\n"
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":     {"text/plain; charset=utf-8"},
+			"Www-Authenticate": {fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", BasicAuthRealm)},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+}
@@ -1,31 +1,91 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/samuelships/harlot/server"
 	"github.com/samuelships/harlot/utils"
 )
 
+const (
+	// ReconnectMinBackoff and ReconnectMaxBackoff space out the attempts
+	// to get a dropped tunnel back
+	ReconnectMinBackoff = 500 * time.Millisecond
+	ReconnectMaxBackoff = 30 * time.Second
+)
+
 var MainSessionStore = NewSessionStore()
 var MainReqResQueue = NewReqResQueue()
 
 type Client struct {
 	Conn    *net.Conn
 	Address string
+	// ServerVersion and Capabilities are learned in the hello exchange
+	ServerVersion string
+	Capabilities  server.Capability
 }
 
+// NewClient connects to the server and says hello, an error wrapping
+// server.IncompatibleProtocolError means one side has to be upgraded
 func NewClient(address string) (*Client, error) {
 	conn, err := dialTls(address)
-	return &Client{Conn: &conn, Address: address}, err
+	client := &Client{Conn: &conn, Address: address}
+	if err != nil {
+		return client, err
+	}
+
+	err = client.hello()
+	if err != nil {
+		conn.Close()
+	}
+
+	return client, err
 }
 
 func (c *Client) FromOld() (*Client, error) {
-	conn, err := dialTls(c.Address)
-	return &Client{Conn: &conn, Address: c.Address}, err
+	return NewClient(c.Address)
+}
+
+// hello opens every connection, it settles the protocol version and the
+// capabilities used on it
+func (c *Client) hello() error {
+	err := server.WriteUint32(*c.Conn, uint32(server.Hello))
+	if err != nil {
+		return fmt.Errorf("Failed to write hello action : %w", err)
+	}
+
+	err = server.WriteHelloRequest(*c.Conn, &server.HelloRequest{
+		ProtocolVersion: server.ProtocolVersion,
+		ClientVersion:   server.Version,
+		Capabilities:    server.SupportedCapabilities,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write hello : %w", err)
+	}
+
+	resp, err := server.ReadHelloResponse(*c.Conn)
+	if err != nil {
+		return fmt.Errorf("%w : the server did not answer the hello, it is likely older than this client (%v)", server.IncompatibleProtocolError, err)
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("%w : %s", server.IncompatibleProtocolError, resp.Error)
+	}
+
+	if !server.IsSupportedProtocol(resp.ProtocolVersion) {
+		return fmt.Errorf("%w : server %s answered with protocol version %d but client %s speaks %d to %d",
+			server.IncompatibleProtocolError, resp.ServerVersion, resp.ProtocolVersion,
+			server.Version, server.MinProtocolVersion, server.ProtocolVersion)
+	}
+
+	c.ServerVersion = resp.ServerVersion
+	c.Capabilities = resp.Capabilities
+	return nil
 }
 
 func (c *Client) Register() (string, error) {
@@ -75,89 +135,192 @@ func (c *Client) Login(serverUrl, token string) (bool, error) {
 	return isOk, nil
 }
 
-func logTunnelSuccess(protocol, subdomain, serverUrl string) {
-	serverUrl = strings.Split(serverUrl, ":")[0]
-	tunnelUrl := fmt.Sprintf("https://%s", subdomain + "." + serverUrl)
-	utils.LogInfo(fmt.Sprintf("Tunnel established! Access your service at %s", tunnelUrl))
+// Reserve keeps the subdomain for the token even while no tunnel uses it,
+// the code says why the server refused
+func (c *Client) Reserve(token, subdomain string) (server.TunnelErrorCode, error) {
+	return c.reservation(server.Reserve, token, subdomain)
 }
 
-func logTunnelError() {
-	utils.LogInfo("Error establishing tunnel")
+// Release gives up a reserved subdomain
+func (c *Client) Release(token, subdomain string) (server.TunnelErrorCode, error) {
+	return c.reservation(server.Release, token, subdomain)
 }
 
-func (c *Client) Tunnel(serverUrl, token, subdomain, protocol string, isTls bool, port int) error {
+func (c *Client) reservation(action server.Action, token, subdomain string) (server.TunnelErrorCode, error) {
 	defer (*c.Conn).Close()
 
-	// action
-	err := server.WriteUint32(*c.Conn, uint32(server.Tunnel))
+	err := server.WriteUint32(*c.Conn, uint32(action))
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write tunnel action : %w", err)
+		return server.InternalErrorCode, utils.LogErrorReturn("Failed to write reservation action : %w", err)
 	}
 
-	// token length
-	err = server.WriteUint32(*c.Conn, uint32(len(token)))
+	err = server.WriteReservationRequest(*c.Conn, &server.ReservationRequest{Token: token, Subdomain: subdomain})
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write token length : %w", err)
+		return server.InternalErrorCode, utils.LogErrorReturn("Failed to write reservation request : %w", err)
 	}
 
-	// token
-	err = server.WriteBuffer(*c.Conn, []byte(token))
+	code, err := server.ReadUint32(*c.Conn)
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write token : %w", err)
+		return server.InternalErrorCode, utils.LogErrorReturn("Failed to read result : %w", err)
+	}
+
+	return server.TunnelErrorCode(code), nil
+}
+
+func logTunnelSuccess(req *server.TunnelRequest, serverUrl string, port uint32) {
+	serverUrl = strings.Split(serverUrl, ":")[0]
+	tunnelUrl := fmt.Sprintf("https://%s", req.Subdomain+"."+serverUrl)
+	if server.IsTcpProtocol(req.Protocol) {
+		tunnelUrl = fmt.Sprintf("tcp://%s:%d", serverUrl, port)
+	}
+
+	if server.IsUdpProtocol(req.Protocol) {
+		tunnelUrl = fmt.Sprintf("udp://%s:%d", serverUrl, port)
 	}
 
+	utils.LogInfo(fmt.Sprintf("Tunnel established! Access your service at %s", tunnelUrl))
+	if req.Hostname != "" {
+		utils.LogInfo(fmt.Sprintf("Custom domain bound, point a CNAME for %s at %s", req.Hostname, serverUrl))
+	}
+}
+
+func logTunnelError() {
+	utils.LogInfo("Error establishing tunnel")
+}
+
+// Tunnel opens the control connection for a tunnel, the request carries what
+// the server needs to know while the service describes the local side
+func (c *Client) Tunnel(serverUrl, token string, req *server.TunnelRequest, service *Service) error {
+	defer func() {
+		(*c.Conn).Close()
+	}()
+
 	sessionID, err := server.GenerateToken(32)
+	if err != nil {
+		return utils.LogErrorReturn("Failed to generate session id : %w", err)
+	}
 
-	// session id length
-	err = server.WriteUint32(*c.Conn, uint32(len(sessionID)))
+	req.Token = token
+	req.SessionID = sessionID
+	req.Protocol = service.Protocol
+	req.Http2 = service.OffersHttp2()
+
+	err = c.checkCapabilities(req)
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write tunnel action : %w", err)
+		return err
 	}
 
-	// session
-	err = server.WriteBuffer(*c.Conn, []byte(sessionID))
+	err = c.openTunnel(serverUrl, req, service)
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write token : %w", err)
+		return err
 	}
 
-	// subdomain length
-	err = server.WriteUint32(*c.Conn, uint32(len(subdomain)))
+	// add service
+	MainSessionStore.AddService(sessionID, service)
+	defer MainSessionStore.RemoveService(sessionID)
+
+	for {
+		err := c.serveTunnel(sessionID, service)
+		utils.LogInfo("Lost connection to server, reconnecting", slog.String("err", err.Error()))
+
+		err = c.reconnect(serverUrl, req, service)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkCapabilities makes sure the server agreed on the features the tunnel
+// needs
+func (c *Client) checkCapabilities(req *server.TunnelRequest) error {
+	if server.IsUdpProtocol(req.Protocol) && !c.Capabilities.Has(server.UdpCapability) {
+		return utils.LogErrorReturn("Server %s does not support udp tunnels", c.ServerVersion)
+	}
+
+	if req.ForwardAddr && !c.Capabilities.Has(server.ForwardAddrCapability) {
+		return utils.LogErrorReturn("Server %s does not forward peer addresses, the proxy protocol and forwarded headers are unavailable", c.ServerVersion)
+	}
+
+	return nil
+}
+
+// openTunnel sends the tunnel request and applies what the server settled
+// on to the request and the service
+func (c *Client) openTunnel(serverUrl string, req *server.TunnelRequest, service *Service) error {
+	// action
+	err := server.WriteUint32(*c.Conn, uint32(server.Tunnel))
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write subdomain length : %w", err)
+		return utils.LogErrorReturn("Failed to write tunnel action : %w", err)
 	}
 
-	// subdomain
-	err = server.WriteBuffer(*c.Conn, []byte(subdomain))
+	err = server.WriteTunnelRequest(*c.Conn, req)
 	if err != nil {
-		return utils.LogErrorReturn("Failed to write subdomain : %w", err)
+		return utils.LogErrorReturn("Failed to write tunnel request : %w", err)
 	}
 
 	// read status (sucess / error)
-	success, err := server.ReadBool(*c.Conn)
+	resp, err := server.ReadTunnelResponse(*c.Conn)
 	if err != nil {
 		logTunnelError()
-		return utils.LogErrorReturn("Failed to read success message : %v", err)
+		return utils.LogErrorReturn("Failed to read success message : %w", err)
 	}
 
-	if !success {
+	if !resp.Success {
 		logTunnelError()
-		return utils.LogErrorReturn("Error in creating session : %v", err)
+		utils.LogError("Tunnel refused", slog.String("reason", resp.Error), slog.Int("code", int(resp.ErrorCode)))
+		return resp.Err()
 	}
 
-	logTunnelSuccess(protocol, subdomain, serverUrl)
-
-	// add service
-	service := &Service{IsTls: isTls, Port: port, Protocol: protocol}
-	MainSessionStore.AddService(sessionID, service)
-	defer MainSessionStore.RemoveService(sessionID)
+	req.Subdomain = resp.Subdomain
+	req.ResumeToken = resp.ResumeToken
+	logTunnelSuccess(req, serverUrl, resp.Port)
+	service.MaxConns = int(resp.MaxConns)
+	return nil
+}
 
+// serveTunnel opens the pool connections asked for by the server until the
+// control connection drops
+func (c *Client) serveTunnel(sessionID string, service *Service) error {
 	for {
 		spawnCount, err := server.ReadUint32(*c.Conn)
 		if err != nil {
-			return utils.LogErrorReturn("Failed to read spawn Value : %v", err)
+			return err
+		}
+
+		SpinUp(c, sessionID, spawnCount, service)
+	}
+}
+
+// reconnect dials the server until the tunnel is back, the resume token
+// lets the server hand back the same session while it is holding it. A
+// refused tunnel is given up on
+func (c *Client) reconnect(serverUrl string, req *server.TunnelRequest, service *Service) error {
+	backoff := ReconnectMinBackoff
+	for {
+		time.Sleep(backoff)
+		backoff = min(backoff*2, ReconnectMaxBackoff)
+
+		newClient, err := c.FromOld()
+		if err != nil {
+			utils.LogInfo("Failed to reach server, retrying", slog.Duration("in", backoff))
+			continue
+		}
+
+		err = newClient.openTunnel(serverUrl, req, service)
+		var refused *server.TunnelRefusedError
+		if errors.As(err, &refused) {
+			(*newClient.Conn).Close()
+			return err
+		}
+
+		if err != nil {
+			(*newClient.Conn).Close()
+			continue
 		}
 
-		SpinUp(c, sessionID, spawnCount)
+		(*c.Conn).Close()
+		c.Conn = newClient.Conn
+		return nil
 	}
 }
 
@@ -196,12 +359,25 @@ func (c *Client) PoolWorker(sessionID string) error {
 	return nil
 }
 
-func SpinUp(client *Client, sessionID string, spawnCount uint32) {
+// SpinUp opens the pool connections asked for by the server, never going
+// over the service's connection limit
+func SpinUp(client *Client, sessionID string, spawnCount uint32, service *Service) {
+	limited := service.MaxConns > 0
 	for i := 0; i < int(spawnCount); i++ {
+		if limited && service.Workers.Add(1) > int64(service.MaxConns) {
+			service.Workers.Add(-1)
+			return
+		}
+
 		go func() {
+			if limited {
+				defer service.Workers.Add(-1)
+			}
+
 			newClient, err := (*client).FromOld()
 			if err != nil {
-				utils.LogInfo("Error creating client")
+				utils.LogInfo("Error creating client", slog.String("err", err.Error()))
+				return
 			}
 
 			err = newClient.PoolWorker(sessionID)
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
@@ -79,9 +80,46 @@ func NewReqResQueue() *ReqResQueue {
 }
 
 type Service struct {
-	Protocol string // valid : http / https / tcp / tcps
+	Protocol string // valid : http / https / tcp / tcps / udp
 	IsTls    bool
 	Port     int
+	// ProxyProtocol is the PROXY protocol version written to the local
+	// service before any data, 0 disables it
+	ProxyProtocol int
+	// ForwardedHeaders adds X-Forwarded-* and Forwarded to http requests
+	ForwardedHeaders bool
+	// Http2 offers h2 over alpn, the local service has to speak HTTP/2 too
+	Http2 bool
+	// BasicAuth users may access the tunnel, everyone else gets a 401
+	BasicAuth []BasicAuthUser
+	// HostHeader is what the local service sees as Host, see
+	// HostHeaderPreserve and HostHeaderRewrite. RewriteOrigin changes
+	// Origin and Referer to match
+	HostHeader    string
+	RewriteOrigin bool
+	// Routes send requests under a path prefix to other local ports, the
+	// longest prefix wins and Port serves the rest
+	Routes []Route
+	// MaxConns is the connection limit agreed with the server, Workers
+	// counts the pool connections currently open
+	MaxConns int
+	Workers  atomic.Int64
+}
+
+// UsesHttpProxy reports whether requests have to be rewritten, which needs
+// the request by request proxy instead of copying raw bytes
+func (s *Service) UsesHttpProxy() bool {
+	return s.ForwardedHeaders || len(s.BasicAuth) > 0 || s.RewritesHost() || len(s.Routes) > 0
+}
+
+func (s *Service) RewritesHost() bool {
+	return s.HostHeader != "" && s.HostHeader != HostHeaderPreserve
+}
+
+// OffersHttp2 reports whether h2 may be negotiated, h2 is only relayed as
+// is so it is not offered when requests have to be rewritten
+func (s *Service) OffersHttp2() bool {
+	return s.Http2 && !s.UsesHttpProxy()
 }
 
 type SessionStore struct {
@@ -192,45 +230,74 @@ func ProxyToLocal(sessionID string, conn *net.Conn) error {
 
 	var remote io.ReadWriteCloser = *conn
 
-	// server gives us a regular tcp connection
-	// except its tls - terminate it here
-	tlsConfig, err := server.GetServerTlsConfig()
-	if err != nil {
-		return err
-	}
-
-	tlsConn := tls.Server(*conn, tlsConfig)
 	// <- blocks below until server starts proxying data
 	// using this connection
-	err = tlsConn.Handshake() // <- blocks here
-	remote = tlsConn
+	header, err := server.ReadStreamHeader(*conn) // <- blocks here
 	if err != nil {
 		return err
 	}
 
-	var local io.ReadWriteCloser
-	servicePort := fmt.Sprintf(":%d", service.Port)
+	if header.Kind == server.TlsStream {
+		// server gives us a regular tcp connection
+		// except its tls - terminate it here
+		tlsConfig, err := server.GetServerTlsConfig()
+		if err != nil {
+			return err
+		}
 
-	if service.IsTls {
-		local, err = tls.Dial(
-			"tcp",
-			servicePort,
-			getTlsConfig(),
-		)
-	} else {
-		local, err = net.Dial("tcp", servicePort)
+		if service.OffersHttp2() {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		tlsConn := tls.Server(*conn, tlsConfig)
+		err = tlsConn.Handshake()
+		remote = tlsConn
+		if err != nil {
+			return err
+		}
+	}
+
+	if header.Kind == server.UdpStream {
+		return proxyUdp(remote, service)
+	}
+
+	httpProtocols := []string{"http", "https"}
+	isHttp2 := false
+	if slices.Contains(httpProtocols, service.Protocol) {
+		bufferedRemote := &bufferedConn{ReadWriteCloser: remote, reader: bufio.NewReader(remote)}
+		isHttp2 = isHttp2Preface(bufferedRemote.reader)
+		remote = bufferedRemote
+	}
+
+	if isHttp2 && service.UsesHttpProxy() {
+		remote.Close()
+		return errors.New("HTTP/2 requests cannot be rewritten")
 	}
 
+	// local connections are dialed per request, routes may pick other ports
+	if !isHttp2 && slices.Contains(httpProtocols, service.Protocol) && service.UsesHttpProxy() {
+		upstreams := newLocalUpstreams(service, header)
+		err = proxyHttp(remote, upstreams, service, header)
+		upstreams.Close()
+		remote.Close()
+		return err
+	}
+
+	local, err := dialLocal(service, service.Port, header)
 	if err != nil {
 		utils.LogInfo("Error dialing local service : %w", err)
 		return err
 	}
 
+	if isHttp2 {
+		return proxyHttp2(remote, local)
+	}
+
 	// for reading requests
 	remoteReader, remoteSpyReader := createSpyReader(remote)
 	localReader, localSpyReader := createSpyReader(local)
 
-	httpProtocols := []string{"http", "https"}
 	if slices.Contains(httpProtocols, service.Protocol) {
 		go func() {
 			readRequestsLoop(remoteSpyReader, ctx)
@@ -257,13 +324,53 @@ func ProxyToLocal(sessionID string, conn *net.Conn) error {
 	return nil
 }
 
+// dialLocal connects to the local service, the PROXY protocol header goes
+// out first so it sits in front of the tls handshake for tls services
+func dialLocal(service *Service, port int, header *server.StreamHeader) (io.ReadWriteCloser, error) {
+	servicePort := fmt.Sprintf(":%d", port)
+	conn, err := net.Dial("tcp", servicePort)
+	if err != nil {
+		return nil, err
+	}
+
+	if service.ProxyProtocol != NoProxyProtocol {
+		err = writeProxyHeader(conn, service.ProxyProtocol, header)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if service.IsTls {
+		tlsConfig := getTlsConfig()
+		if service.OffersHttp2() {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		return tls.Client(conn, tlsConfig), nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads through a bufio.Reader so the start of the stream can be
+// peeked at without losing it
+type bufferedConn struct {
+	io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
 func createSpyReader(reader io.Reader) (io.Reader, io.Reader) {
 	bufferStorage := bytes.Buffer{}
 	spyReader := io.TeeReader(reader, &bufferStorage)
 	return spyReader, &bufferStorage
 }
 
-// TODO : add support for HTTP/2
+// HTTP/2 connections are decoded by http2Inspector instead
 func readRequestsLoop(reader io.Reader, ctx context.Context) {
 	prevRequestData := []byte{}
 
@@ -369,7 +476,13 @@ func readResponsesLoop(reader io.Reader, ctx context.Context) {
 	}
 }
 
+// logMu keeps lines from different connections from interleaving
+var logMu sync.Mutex
+
 func logRequestResponse(wReq *WrappedReq, wResp *WrappedResp) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
 	yellow := color.New(color.FgYellow).SprintFunc()
 	green := color.New(color.FgGreen).SprintFunc()
 	red := color.New(color.FgRed).SprintFunc()
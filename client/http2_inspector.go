@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	http2Preface = http2.ClientPreface
+	// we only watch the traffic so accept whatever the peers agreed on
+	http2MaxFrameSize     = 1<<24 - 1
+	http2MaxHeaderTableSz = 1 << 16
+)
+
+// isHttp2Preface peeks just enough bytes to tell an HTTP/2 connection
+// preface apart from an HTTP/1.x request line
+func isHttp2Preface(reader *bufio.Reader) bool {
+	for i := 1; i <= len(http2Preface); i++ {
+		data, err := reader.Peek(i)
+		if err != nil {
+			return false
+		}
+
+		if data[i-1] != http2Preface[i-1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+type http2Stream struct {
+	req  *http.Request
+	resp *http.Response
+	body bytes.Buffer
+}
+
+// http2Inspector decodes both directions of an HTTP/2 connection and logs
+// every request / response pair once the response stream ends
+type http2Inspector struct {
+	streams map[uint32]*http2Stream
+	mu      sync.Mutex
+
+	requestDecoder  *hpack.Decoder
+	responseDecoder *hpack.Decoder
+
+	// table sizes announced in SETTINGS, each decoder is only touched by
+	// its own goroutine so the other side hands them over here
+	requestTableSize  atomic.Uint32
+	responseTableSize atomic.Uint32
+}
+
+func newHttp2Inspector() *http2Inspector {
+	return &http2Inspector{
+		streams:         map[uint32]*http2Stream{},
+		requestDecoder:  hpack.NewDecoder(http2MaxHeaderTableSz, nil),
+		responseDecoder: hpack.NewDecoder(http2MaxHeaderTableSz, nil),
+	}
+}
+
+// updateStream runs update on a stream while holding the lock, both
+// directions touch the same streams
+func (in *http2Inspector) updateStream(streamID uint32, update func(*http2Stream)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	stream, ok := in.streams[streamID]
+	if !ok {
+		stream = &http2Stream{}
+		in.streams[streamID] = stream
+	}
+
+	update(stream)
+}
+
+func (in *http2Inspector) removeStream(streamID uint32) *http2Stream {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	stream := in.streams[streamID]
+	delete(in.streams, streamID)
+	return stream
+}
+
+func newInspectorFramer(reader io.Reader, decoder *hpack.Decoder) *http2.Framer {
+	framer := http2.NewFramer(io.Discard, reader)
+	framer.SetMaxReadFrameSize(http2MaxFrameSize)
+	framer.ReadMetaHeaders = decoder
+	return framer
+}
+
+// readRequests decodes the client side, it starts with the preface
+func (in *http2Inspector) readRequests(reader io.Reader) {
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(reader, preface); err != nil || string(preface) != http2Preface {
+		return
+	}
+
+	framer := newInspectorFramer(reader, in.requestDecoder)
+	for {
+		if size := in.requestTableSize.Swap(0); size != 0 {
+			in.requestDecoder.SetAllowedMaxDynamicTableSize(size)
+		}
+
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			// the client's table size limits what the server may encode
+			if size, ok := f.Value(http2.SettingHeaderTableSize); ok {
+				in.responseTableSize.Store(size)
+			}
+		case *http2.MetaHeadersFrame:
+			req := requestFromHeaders(f)
+			in.updateStream(f.StreamID, func(stream *http2Stream) {
+				if stream.req == nil {
+					stream.req = req
+				}
+			})
+		case *http2.RSTStreamFrame:
+			in.removeStream(f.StreamID)
+		}
+	}
+}
+
+// readResponses decodes the server side, there is no preface
+func (in *http2Inspector) readResponses(reader io.Reader) {
+	framer := newInspectorFramer(reader, in.responseDecoder)
+	for {
+		if size := in.responseTableSize.Swap(0); size != 0 {
+			in.responseDecoder.SetAllowedMaxDynamicTableSize(size)
+		}
+
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if size, ok := f.Value(http2.SettingHeaderTableSize); ok {
+				in.requestTableSize.Store(size)
+			}
+		case *http2.MetaHeadersFrame:
+			// informational responses are followed by the real one
+			if resp := responseFromHeaders(f); resp != nil && resp.StatusCode >= 200 {
+				in.updateStream(f.StreamID, func(stream *http2Stream) {
+					stream.resp = resp
+				})
+			}
+
+			if f.StreamEnded() {
+				in.logStream(f.StreamID)
+			}
+		case *http2.DataFrame:
+			data := f.Data()
+			in.updateStream(f.StreamID, func(stream *http2Stream) {
+				stream.body.Write(data)
+			})
+
+			if f.StreamEnded() {
+				in.logStream(f.StreamID)
+			}
+		case *http2.RSTStreamFrame:
+			in.removeStream(f.StreamID)
+		}
+	}
+}
+
+func (in *http2Inspector) logStream(streamID uint32) {
+	stream := in.removeStream(streamID)
+	if stream == nil || stream.req == nil || stream.resp == nil {
+		return
+	}
+
+	logRequestResponse(&WrappedReq{stream.req}, &WrappedResp{Resp: stream.resp, Body: stream.body.Bytes()})
+}
+
+func requestFromHeaders(f *http2.MetaHeadersFrame) *http.Request {
+	path := f.PseudoValue("path")
+	reqUrl, err := url.ParseRequestURI(path)
+	if err != nil {
+		reqUrl = &url.URL{Path: path}
+	}
+
+	header := http.Header{}
+	for _, field := range f.RegularFields() {
+		header.Add(field.Name, field.Value)
+	}
+
+	return &http.Request{
+		Method:     f.PseudoValue("method"),
+		URL:        reqUrl,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		Host:       f.PseudoValue("authority"),
+	}
+}
+
+func responseFromHeaders(f *http2.MetaHeadersFrame) *http.Response {
+	statusCode, err := strconv.Atoi(f.PseudoValue("status"))
+	if err != nil {
+		return nil
+	}
+
+	header := http.Header{}
+	for _, field := range f.RegularFields() {
+		header.Add(field.Name, field.Value)
+	}
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+	}
+}
+
+// inspectorTap returns a writer whose bytes are fed to decode, anything left
+// once decode gives up is drained so the proxied copy never stalls
+func inspectorTap(decode func(io.Reader)) io.WriteCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		decode(pipeReader)
+		io.Copy(io.Discard, pipeReader)
+	}()
+
+	return pipeWriter
+}
+
+// proxyHttp2 copies raw bytes both ways while the inspector watches them
+func proxyHttp2(remote, local io.ReadWriteCloser) error {
+	inspector := newHttp2Inspector()
+	requestTap := inspectorTap(inspector.readRequests)
+	responseTap := inspectorTap(inspector.readResponses)
+
+	go func() {
+		io.Copy(local, io.TeeReader(remote, requestTap))
+		requestTap.Close()
+		local.Close()
+	}()
+
+	io.Copy(remote, io.TeeReader(local, responseTap))
+	responseTap.Close()
+	remote.Close()
+	return nil
+}
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/samuelships/harlot/server"
+	"github.com/samuelships/harlot/utils"
+)
+
+const (
+	// HostHeaderPreserve sends the public host to the local service
+	HostHeaderPreserve = "preserve"
+	// HostHeaderRewrite sends localhost:<port>, any other value is sent as is
+	HostHeaderRewrite = "rewrite"
+)
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// localUpstream is a connection to one local port
+type localUpstream struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+// localUpstreams holds the local connections of one public connection, a
+// port is dialed the first time a request is routed to it
+type localUpstreams struct {
+	service *Service
+	header  *server.StreamHeader
+	conns   map[int]*localUpstream
+}
+
+func newLocalUpstreams(service *Service, header *server.StreamHeader) *localUpstreams {
+	return &localUpstreams{service: service, header: header, conns: map[int]*localUpstream{}}
+}
+
+func (u *localUpstreams) Get(port int) (*localUpstream, error) {
+	if upstream, ok := u.conns[port]; ok {
+		return upstream, nil
+	}
+
+	conn, err := dialLocal(u.service, port, u.header)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := &localUpstream{conn: conn, reader: bufio.NewReader(conn)}
+	u.conns[port] = upstream
+	return upstream, nil
+}
+
+func (u *localUpstreams) Close() {
+	for _, upstream := range u.conns {
+		upstream.conn.Close()
+	}
+}
+
+// proxyHttp forwards requests one at a time instead of copying raw bytes so
+// every request can be rewritten and routed before it reaches the local
+// service
+func proxyHttp(remote io.ReadWriteCloser, upstreams *localUpstreams, service *Service, header *server.StreamHeader) error {
+	remoteReader := bufio.NewReader(remote)
+
+	for {
+		req, err := http.ReadRequest(remoteReader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if len(service.BasicAuth) > 0 && !isAuthorized(req, service.BasicAuth) {
+			resp := newUnauthorizedResponse(req)
+			err = resp.Write(remote)
+			logRequestResponse(&WrappedReq{req}, &WrappedResp{Resp: resp})
+			return err
+		}
+
+		port := service.PortFor(req.URL.Path)
+		rewriteRequest(req, service, header, port)
+
+		local, err := upstreams.Get(port)
+		if err != nil {
+			utils.LogInfo(fmt.Sprintf("Error dialing local service on port %d : %v", port, err))
+			resp := newBadGatewayResponse(req)
+			resp.Write(remote)
+			logRequestResponse(&WrappedReq{req}, &WrappedResp{Resp: resp})
+			return err
+		}
+
+		err = req.Write(local.conn)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.ReadResponse(local.reader, req)
+		if err != nil {
+			return err
+		}
+
+		var body bytes.Buffer
+		resp.Body = &teeReadCloser{Reader: io.TeeReader(resp.Body, &body), Closer: resp.Body}
+		err = resp.Write(remote)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		logRequestResponse(&WrappedReq{req}, &WrappedResp{Resp: resp, Body: body.Bytes()})
+
+		// the connection speaks something else from here on (websockets)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			go func() {
+				io.Copy(local.conn, remoteReader)
+				local.conn.Close()
+			}()
+
+			io.Copy(remote, local.reader)
+			return nil
+		}
+
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// newBadGatewayResponse tells the public client a routed local port is down
+func newBadGatewayResponse(req *http.Request) *http.Response {
+	body := "Local service unavailable\n"
+	return &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+}
+
+func rewriteRequest(req *http.Request, service *Service, header *server.StreamHeader, port int) {
+	// keep req.Write from adding its own user agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = nil
+	}
+
+	if service.ForwardedHeaders {
+		addForwardedHeaders(req, header)
+	}
+
+	if service.RewritesHost() {
+		rewriteHost(req, service, port)
+	}
+}
+
+// rewriteHost points the request at the local service's own host, Origin
+// and Referer follow when they name the public host
+func rewriteHost(req *http.Request, service *Service, port int) {
+	publicHost := req.Host
+	localHost := service.HostHeader
+	if localHost == HostHeaderRewrite {
+		localHost = fmt.Sprintf("localhost:%d", port)
+	}
+	req.Host = localHost
+	if !service.RewriteOrigin {
+		return
+	}
+
+	scheme := "http"
+	if service.IsTls {
+		scheme = "https"
+	}
+
+	for _, name := range []string{"Origin", "Referer"} {
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		target, err := url.Parse(value)
+		if err != nil || !strings.EqualFold(target.Host, publicHost) {
+			continue
+		}
+
+		target.Scheme = scheme
+		target.Host = localHost
+		req.Header.Set(name, target.String())
+	}
+}
+
+// addForwardedHeaders adds the de facto X-Forwarded-* headers and the
+// standard Forwarded header (RFC 7239) describing the public client
+func addForwardedHeaders(req *http.Request, header *server.StreamHeader) {
+	proto := "http"
+	if header.Kind == server.TlsStream || header.Kind == server.TerminatedTlsStream {
+		proto = "https"
+	}
+
+	clientIP, _, err := net.SplitHostPort(header.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+
+	if clientIP != "" {
+		forwardedFor := clientIP
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			forwardedFor = strings.Join(prior, ", ") + ", " + clientIP
+		}
+
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+
+	forwarded := fmt.Sprintf("host=%q;proto=%s", req.Host, proto)
+	if clientIP != "" {
+		forwarded = fmt.Sprintf("for=%s;%s", forwardedNode(clientIP), forwarded)
+	}
+
+	req.Header.Add("Forwarded", forwarded)
+}
+
+// forwardedNode formats an ip for the Forwarded header, ipv6 has to be
+// bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+
+	return ip
+}
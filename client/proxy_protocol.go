@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/samuelships/harlot/server"
+)
+
+const (
+	NoProxyProtocol = 0
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseProxyProtocol turns the cli value into a proxy protocol version
+func ParseProxyProtocol(value string) (int, error) {
+	switch value {
+	case "":
+		return NoProxyProtocol, nil
+	case "v1":
+		return ProxyProtocolV1, nil
+	case "v2":
+		return ProxyProtocolV2, nil
+	default:
+		return 0, fmt.Errorf("invalid proxy protocol version %q", value)
+	}
+}
+
+// writeProxyHeader writes a HAProxy PROXY protocol header describing the
+// public connection, UNKNOWN / LOCAL is sent when the addresses are missing
+func writeProxyHeader(writer io.Writer, version int, header *server.StreamHeader) error {
+	src, srcOk := splitAddr(header.RemoteAddr)
+	dst, dstOk := splitAddr(header.LocalAddr)
+	known := srcOk && dstOk && (src.IP.To4() == nil) == (dst.IP.To4() == nil)
+
+	switch version {
+	case ProxyProtocolV1:
+		return writeProxyHeaderV1(writer, src, dst, known)
+	case ProxyProtocolV2:
+		return writeProxyHeaderV2(writer, src, dst, known)
+	default:
+		return nil
+	}
+}
+
+func writeProxyHeaderV1(writer io.Writer, src, dst *net.TCPAddr, known bool) error {
+	if !known {
+		_, err := io.WriteString(writer, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+
+	_, err := fmt.Fprintf(writer, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+	return err
+}
+
+func writeProxyHeaderV2(writer io.Writer, src, dst *net.TCPAddr, known bool) error {
+	var buffer bytes.Buffer
+	buffer.Write(proxyProtocolV2Signature)
+
+	if !known {
+		// version 2, LOCAL command, unspecified family
+		buffer.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		_, err := writer.Write(buffer.Bytes())
+		return err
+	}
+
+	var addresses []byte
+	family := byte(0x11) // TCP over IPv4
+	if srcIP := src.IP.To4(); srcIP != nil {
+		addresses = append(addresses, srcIP...)
+		addresses = append(addresses, dst.IP.To4()...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addresses = append(addresses, src.IP.To16()...)
+		addresses = append(addresses, dst.IP.To16()...)
+	}
+
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(src.Port))
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(dst.Port))
+
+	// version 2, PROXY command
+	buffer.WriteByte(0x21)
+	buffer.WriteByte(family)
+	binary.Write(&buffer, binary.BigEndian, uint16(len(addresses)))
+	buffer.Write(addresses)
+
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+func splitAddr(addr string) (*net.TCPAddr, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, true
+}
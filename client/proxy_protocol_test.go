@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/samuelships/harlot/server"
+)
+
+// the v2 signature from the HAProxy spec, section 2.2
+var specSignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+func tcpAddr(t *testing.T, addr string) *net.TCPAddr {
+	t.Helper()
+
+	tcpAddr, ok := splitAddr(addr)
+	if !ok {
+		t.Fatalf("splitAddr(%q) failed", addr)
+	}
+
+	return tcpAddr
+}
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		known    bool
+		want     string
+	}{
+		{"tcp4", "192.168.0.1:56324", "192.168.0.11:443", true, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"},
+		{
+			"tcp6 worst case",
+			"[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", true,
+			"PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+		},
+		{"tcp6", "[2001:db8::1]:1234", "[2001:db8::2]:443", true, "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n"},
+		{"unknown", "192.168.0.1:56324", "192.168.0.11:443", false, "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := writeProxyHeaderV1(&buffer, tcpAddr(t, tc.src), tcpAddr(t, tc.dst), tc.known)
+			if err != nil {
+				t.Fatalf("writeProxyHeaderV1: %v", err)
+			}
+
+			if buffer.String() != tc.want {
+				t.Errorf("header = %q, want %q", buffer.String(), tc.want)
+			}
+
+			// the spec caps v1 headers at 107 bytes
+			if buffer.Len() > 107 {
+				t.Errorf("header is %d bytes long", buffer.Len())
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		known    bool
+		want     []byte
+	}{
+		{
+			"tcp4", "192.168.0.1:56324", "192.168.0.11:443", true,
+			[]byte{
+				0x21, 0x11, 0x00, 0x0C,
+				0xC0, 0xA8, 0x00, 0x01,
+				0xC0, 0xA8, 0x00, 0x0B,
+				0xDC, 0x04,
+				0x01, 0xBB,
+			},
+		},
+		{
+			"tcp6", "[2001:db8::1]:1234", "[2001:db8::2]:443", true,
+			[]byte{
+				0x21, 0x21, 0x00, 0x24,
+				0x20, 0x01, 0x0D, 0xB8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				0x20, 0x01, 0x0D, 0xB8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+				0x04, 0xD2,
+				0x01, 0xBB,
+			},
+		},
+		{
+			"ipv4 mapped ipv6 is sent as tcp4", "[::ffff:10.0.0.1]:80", "[::ffff:10.0.0.2]:8080", true,
+			[]byte{
+				0x21, 0x11, 0x00, 0x0C,
+				0x0A, 0x00, 0x00, 0x01,
+				0x0A, 0x00, 0x00, 0x02,
+				0x00, 0x50,
+				0x1F, 0x90,
+			},
+		},
+		{"local", "192.168.0.1:56324", "192.168.0.11:443", false, []byte{0x20, 0x00, 0x00, 0x00}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := writeProxyHeaderV2(&buffer, tcpAddr(t, tc.src), tcpAddr(t, tc.dst), tc.known)
+			if err != nil {
+				t.Fatalf("writeProxyHeaderV2: %v", err)
+			}
+
+			want := append(append([]byte{}, specSignature...), tc.want...)
+			if !bytes.Equal(buffer.Bytes(), want) {
+				t.Errorf("header = % x, want % x", buffer.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header *server.StreamHeader
+		want   string
+	}{
+		{"known", &server.StreamHeader{RemoteAddr: "203.0.113.7:40000", LocalAddr: "198.51.100.1:443"}, "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n"},
+		{"missing address", &server.StreamHeader{RemoteAddr: "203.0.113.7:40000"}, "PROXY UNKNOWN\r\n"},
+		{"mixed families", &server.StreamHeader{RemoteAddr: "[2001:db8::1]:40000", LocalAddr: "198.51.100.1:443"}, "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := writeProxyHeader(&buffer, ProxyProtocolV1, tc.header)
+			if err != nil {
+				t.Fatalf("writeProxyHeader: %v", err)
+			}
+
+			if buffer.String() != tc.want {
+				t.Errorf("header = %q, want %q", buffer.String(), tc.want)
+			}
+		})
+	}
+}
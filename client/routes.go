@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route sends requests whose path is under Prefix to a local port
+type Route struct {
+	Prefix string
+	Port   int
+}
+
+// ParseRoutes turns the repeated /prefix=port cli values into routes, the
+// longest prefixes come first
+func ParseRoutes(values []string) ([]Route, error) {
+	routes := []Route{}
+	for _, value := range values {
+		prefix, portValue, found := strings.Cut(value, "=")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route %q, expected /prefix=port", value)
+		}
+
+		port, err := strconv.Atoi(portValue)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in route %q", value)
+		}
+
+		routes = append(routes, Route{Prefix: prefix, Port: port})
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+
+	return routes, nil
+}
+
+// Matches reports whether the path is the prefix or below it, /api matches
+// /api and /api/users but not /apikeys
+func (r *Route) Matches(path string) bool {
+	if !strings.HasPrefix(path, r.Prefix) {
+		return false
+	}
+
+	rest := path[len(r.Prefix):]
+	return rest == "" || strings.HasSuffix(r.Prefix, "/") || strings.HasPrefix(rest, "/")
+}
+
+// PortFor picks the local port serving a request path
+func (s *Service) PortFor(path string) int {
+	for _, route := range s.Routes {
+		if route.Matches(path) {
+			return route.Port
+		}
+	}
+
+	return s.Port
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		path    string
+		matches bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/", true},
+		{"/api", "/api/users", true},
+		{"/api", "/apikeys", false},
+		{"/api", "/ap", false},
+		{"/api", "/", false},
+		{"/api", "/v1/api", false},
+		{"/api/", "/api/users", true},
+		{"/api/", "/api", false},
+		{"/", "/", true},
+		{"/", "/anything", true},
+		{"/static/js", "/static/js/app.js", true},
+		{"/static/js", "/static/json", false},
+	}
+
+	for _, tc := range tests {
+		route := &Route{Prefix: tc.prefix, Port: 3000}
+		if matches := route.Matches(tc.path); matches != tc.matches {
+			t.Errorf("Route %q Matches(%q) = %v, want %v", tc.prefix, tc.path, matches, tc.matches)
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		routes []Route
+	}{
+		{"none", nil, []Route{}},
+		{"single", []string{"/api=3001"}, []Route{{"/api", 3001}}},
+		{
+			"longest prefix first",
+			[]string{"/=3000", "/api=3001", "/api/admin=3002"},
+			[]Route{{"/api/admin", 3002}, {"/api", 3001}, {"/", 3000}},
+		},
+		{
+			"equal lengths keep their order",
+			[]string{"/api=3001", "/web=3002"},
+			[]Route{{"/api", 3001}, {"/web", 3002}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			routes, err := ParseRoutes(tc.values)
+			if err != nil {
+				t.Fatalf("ParseRoutes: %v", err)
+			}
+
+			if !reflect.DeepEqual(routes, tc.routes) {
+				t.Errorf("ParseRoutes = %v, want %v", routes, tc.routes)
+			}
+		})
+	}
+}
+
+func TestParseRoutesRejects(t *testing.T) {
+	for _, value := range []string{"", "/api", "api=3001", "/api=", "/api=http", "/api=0", "/api=65536", "/api=-1"} {
+		if _, err := ParseRoutes([]string{value}); err == nil {
+			t.Errorf("ParseRoutes(%q): no error", value)
+		}
+	}
+}
+
+func TestPortFor(t *testing.T) {
+	routes, err := ParseRoutes([]string{"/api=3001", "/apikeys=3002"})
+	if err != nil {
+		t.Fatalf("ParseRoutes: %v", err)
+	}
+
+	service := &Service{Port: 3000, Routes: routes}
+	tests := map[string]int{
+		"/":               3000,
+		"/api":            3001,
+		"/api/users":      3001,
+		"/apikeys":        3002,
+		"/apikeys/rotate": 3002,
+		"/apiv2":          3000,
+	}
+
+	for path, port := range tests {
+		if got := service.PortFor(path); got != port {
+			t.Errorf("PortFor(%q) = %d, want %d", path, got, port)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/samuelships/harlot/server"
+)
+
+// proxyUdp replays the datagrams of one public peer to the local service and
+// frames the replies back, the flow ends when the server closes it
+func proxyUdp(remote io.ReadWriteCloser, service *Service) error {
+	local, err := net.Dial("udp", fmt.Sprintf(":%d", service.Port))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			datagram, err := server.ReadDatagram(remote)
+			if err != nil {
+				break
+			}
+
+			_, err = local.Write(datagram)
+			if err != nil {
+				break
+			}
+		}
+
+		local.Close()
+	}()
+
+	buffer := make([]byte, server.MaxDatagramSize)
+	for {
+		n, err := local.Read(buffer)
+		if err != nil {
+			break
+		}
+
+		err = server.WriteDatagram(remote, buffer[:n])
+		if err != nil {
+			break
+		}
+	}
+
+	remote.Close()
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	HostNotAllowedError = errors.New("Host not allowed for certificate")
+)
+
+// MainCertManager issues certificates over acme, it is nil unless acme is enabled
+var MainCertManager *autocert.Manager
+
+// NewCertManager creates an acme manager for the config, certificates are
+// cached on disk and solved with the http-01 or tls-alpn-01 challenges
+func NewCertManager(config *Config) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: config.AcmeDirectoryURL}
+
+	// lets a local pebble instance with its own ca be used
+	if config.AcmeCAFile != "" {
+		caCert, err := os.ReadFile(config.AcmeCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("No certificates found in acme ca file")
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.AcmeCacheDir),
+		HostPolicy: certHostPolicy,
+		Client:     client,
+		Email:      config.AcmeEmail,
+	}, nil
+}
+
+// certHostPolicy only allows certificates for the server's own hosts and
+// hostnames that currently have a tunnel
+func certHostPolicy(ctx context.Context, host string) error {
+	if MainConfig.IsAcmeHost(host) {
+		return nil
+	}
+
+	if _, err := getSessionForHost(host); err == nil {
+		return nil
+	}
+
+	return HostNotAllowedError
+}
+
+// IsAcmeChallengeRequest reports whether an http request is an http-01
+// challenge that the cert manager should answer
+func IsAcmeChallengeRequest(req *http.Request) bool {
+	return MainCertManager != nil && strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/")
+}
@@ -3,13 +3,30 @@ package server
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/samuelships/harlot/utils"
 )
 
+const (
+	// MaxStringLength caps the strings read off the control protocol, the
+	// longest ones are tokens, session ids and hostnames
+	MaxStringLength = 4096
+	// MaxStringListLength caps the entries of a string list
+	MaxStringListLength = 256
+)
+
+var (
+	StringTooLongError     = errors.New("String too long")
+	StringListTooLongError = errors.New("String list too long")
+	InvalidIpRulesError    = errors.New("Ip rules are invalid")
+)
+
 func ReadUint32(reader io.Reader) (uint32, error) {
 	var result uint32
 	err := binary.Read(reader, binary.BigEndian, &result)
@@ -43,21 +60,433 @@ func WriteBuffer(writer io.Writer, value []byte) error {
 	return err
 }
 
-func HandleLoginAction(conn *net.Conn) {
-	tokenLength, err := ReadUint32(*conn)
+func ReadString(reader io.Reader) (string, error) {
+	length, err := ReadUint32(reader)
 	if err != nil {
-		utils.LogInfo("Failed to read token length", err)
-		return
+		return "", err
+	}
+
+	if length > MaxStringLength {
+		return "", StringTooLongError
+	}
+
+	buffer, err := ReadIntoBuffer(reader, length)
+	return string(buffer), err
+}
+
+func WriteString(writer io.Writer, value string) error {
+	err := WriteUint32(writer, uint32(len(value)))
+	if err != nil {
+		return err
+	}
+
+	return WriteBuffer(writer, []byte(value))
+}
+
+func ReadStringList(reader io.Reader) ([]string, error) {
+	count, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > MaxStringListLength {
+		return nil, StringListTooLongError
+	}
+
+	values := []string{}
+	for i := uint32(0); i < count; i++ {
+		value, err := ReadString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func WriteStringList(writer io.Writer, values []string) error {
+	err := WriteUint32(writer, uint32(len(values)))
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if err := WriteString(writer, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TunnelRequest is sent by the client after the tunnel action
+type TunnelRequest struct {
+	Token     string
+	SessionID string
+	Subdomain string
+	Protocol  string
+	// Hostname is an optional custom domain claimed by the token
+	Hostname string
+	// ForwardAddr asks the server to send the public peer address along
+	// with every connection
+	ForwardAddr bool
+	// Group lets several clients with the same token share the subdomain
+	Group bool
+	// Allow and Deny are cidrs of the public peers let through or refused
+	Allow []string
+	Deny  []string
+	// MaxConns asks for a lower connection limit than the server's, 0 takes
+	// the server's
+	MaxConns uint32
+	// ResumeToken reattaches to the session of a dropped tunnel connection
+	ResumeToken string
+	// Http2 asks for h2 to be offered to public clients when the server
+	// terminates tls, the client relays it to the local service as is
+	Http2 bool
+}
+
+func WriteTunnelRequest(writer io.Writer, req *TunnelRequest) error {
+	fields := []string{req.Token, req.SessionID, req.Subdomain, req.Protocol, req.Hostname}
+	for _, field := range fields {
+		if err := WriteString(writer, field); err != nil {
+			return err
+		}
+	}
+
+	err := WriteBool(writer, req.ForwardAddr)
+	if err != nil {
+		return err
+	}
+
+	err = WriteBool(writer, req.Group)
+	if err != nil {
+		return err
+	}
+
+	err = WriteStringList(writer, req.Allow)
+	if err != nil {
+		return err
+	}
+
+	err = WriteStringList(writer, req.Deny)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, req.MaxConns)
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, req.ResumeToken)
+	if err != nil {
+		return err
+	}
+
+	return WriteBool(writer, req.Http2)
+}
+
+func ReadTunnelRequest(reader io.Reader) (*TunnelRequest, error) {
+	req := &TunnelRequest{}
+	fields := []*string{&req.Token, &req.SessionID, &req.Subdomain, &req.Protocol, &req.Hostname}
+	for _, field := range fields {
+		value, err := ReadString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		*field = value
+	}
+
+	forwardAddr, err := ReadBool(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := ReadBool(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	allow, err := ReadStringList(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := ReadStringList(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	maxConns, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	resumeToken, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	http2, err := ReadBool(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ResumeToken = resumeToken
+	req.Http2 = http2
+	req.ForwardAddr = forwardAddr
+	req.Group = group
+	req.Allow = allow
+	req.Deny = deny
+	req.MaxConns = maxConns
+	return req, nil
+}
+
+// TunnelErrorCode tells the client why a tunnel was refused
+type TunnelErrorCode uint32
+
+const (
+	NoErrorCode TunnelErrorCode = iota
+	InternalErrorCode
+	InvalidTokenCode
+	QuotaExceededCode
+	InvalidSubdomainCode
+	BlockedSubdomainCode
+	SubdomainTakenCode
+	InvalidHostnameCode
+	HostnameTakenCode
+	InvalidIpRulesCode
+	NoFreePortCode
+	ResumeRefusedCode
+	UnsupportedFeatureCode
+	SubdomainNotReservedCode
+)
+
+var tunnelErrorCodeMessages = map[TunnelErrorCode]string{
+	NoErrorCode:              "no error",
+	InternalErrorCode:        "internal server error",
+	InvalidTokenCode:         "token is invalid",
+	QuotaExceededCode:        "monthly quota exceeded",
+	InvalidSubdomainCode:     "subdomain is invalid",
+	BlockedSubdomainCode:     "subdomain is blocked",
+	SubdomainTakenCode:       "subdomain is reserved or in use by another token",
+	InvalidHostnameCode:      "hostname is invalid",
+	HostnameTakenCode:        "hostname is in use by another token",
+	InvalidIpRulesCode:       "ip rules are invalid",
+	NoFreePortCode:           "no free port",
+	ResumeRefusedCode:        "tunnel cannot be resumed",
+	UnsupportedFeatureCode:   "feature was not agreed on",
+	SubdomainNotReservedCode: "subdomain is not reserved by this token",
+}
+
+func (c TunnelErrorCode) String() string {
+	message, ok := tunnelErrorCodeMessages[c]
+	if !ok {
+		return fmt.Sprintf("unknown error %d", uint32(c))
+	}
+
+	return message
+}
+
+// TunnelErrorCodeOf maps the errors refusing a tunnel to the code sent to
+// the client
+func TunnelErrorCodeOf(err error) TunnelErrorCode {
+	switch {
+	case err == nil:
+		return NoErrorCode
+	case errors.Is(err, InvalidTokenError):
+		return InvalidTokenCode
+	case errors.Is(err, QuotaExceededError):
+		return QuotaExceededCode
+	case errors.Is(err, InvalidSubdomainError):
+		return InvalidSubdomainCode
+	case errors.Is(err, BlockedSubdomainError):
+		return BlockedSubdomainCode
+	case errors.Is(err, SubdomainReservedError), errors.Is(err, SubdomainAlreadyExistsError):
+		return SubdomainTakenCode
+	case errors.Is(err, InvalidHostnameError):
+		return InvalidHostnameCode
+	case errors.Is(err, HostnameClaimedError), errors.Is(err, HostnameAlreadyExistsError):
+		return HostnameTakenCode
+	case errors.Is(err, InvalidIpRulesError):
+		return InvalidIpRulesCode
+	case errors.Is(err, NoFreePortError):
+		return NoFreePortCode
+	case errors.Is(err, ResumeRefusedError):
+		return ResumeRefusedCode
+	case errors.Is(err, UnsupportedFeatureError):
+		return UnsupportedFeatureCode
+	case errors.Is(err, SubdomainNotReservedError):
+		return SubdomainNotReservedCode
+	default:
+		return InternalErrorCode
+	}
+}
+
+// TunnelRefusedError is what the client gets back for a refused tunnel
+type TunnelRefusedError struct {
+	Code    TunnelErrorCode
+	Message string
+}
+
+func (e *TunnelRefusedError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// TunnelResponse is sent by the server once the tunnel has been set up,
+// Port is only set for tcp and udp tunnels
+type TunnelResponse struct {
+	Success bool
+	Port    uint32
+	// MaxConns is the connection limit the server settled on
+	MaxConns uint32
+	// Subdomain the tunnel is served on, it is picked by the server when
+	// the request left it empty
+	Subdomain string
+	// ErrorCode and Error say why the tunnel was refused
+	ErrorCode TunnelErrorCode
+	Error     string
+	// ResumeToken is sent back to reattach after the tunnel connection
+	// dropped
+	ResumeToken string
+}
+
+// NewTunnelErrorResponse refuses a tunnel with the code matching the error
+func NewTunnelErrorResponse(err error) *TunnelResponse {
+	return &TunnelResponse{Success: false, ErrorCode: TunnelErrorCodeOf(err), Error: err.Error()}
+}
+
+// Err returns the refusal as an error, nil when the tunnel was set up
+func (r *TunnelResponse) Err() error {
+	if r.Success {
+		return nil
+	}
+
+	return &TunnelRefusedError{Code: r.ErrorCode, Message: r.Error}
+}
+
+func WriteTunnelResponse(writer io.Writer, resp *TunnelResponse) error {
+	err := WriteBool(writer, resp.Success)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, resp.Port)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, resp.MaxConns)
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, resp.Subdomain)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, uint32(resp.ErrorCode))
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, resp.Error)
+	if err != nil {
+		return err
+	}
+
+	return WriteString(writer, resp.ResumeToken)
+}
+
+func ReadTunnelResponse(reader io.Reader) (*TunnelResponse, error) {
+	success, err := ReadBool(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	maxConns, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
 	}
 
-	tokenBuf, err := ReadIntoBuffer(*conn, tokenLength)
+	subdomain, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	errorCode, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	resumeToken, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TunnelResponse{
+		Success:     success,
+		Port:        port,
+		MaxConns:    maxConns,
+		Subdomain:   subdomain,
+		ErrorCode:   TunnelErrorCode(errorCode),
+		Error:       message,
+		ResumeToken: resumeToken,
+	}, nil
+}
+
+// ReservationRequest is sent after the reserve and release actions
+type ReservationRequest struct {
+	Token     string
+	Subdomain string
+}
+
+func WriteReservationRequest(writer io.Writer, req *ReservationRequest) error {
+	err := WriteString(writer, req.Token)
+	if err != nil {
+		return err
+	}
+
+	return WriteString(writer, req.Subdomain)
+}
+
+func ReadReservationRequest(reader io.Reader) (*ReservationRequest, error) {
+	token, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	subdomain, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReservationRequest{Token: token, Subdomain: subdomain}, nil
+}
+
+func HandleLoginAction(conn *net.Conn) {
+	token, err := ReadString(*conn)
 	if err != nil {
 		utils.LogInfo("Failed to read token", err)
 		return
 	}
 
 	isTokenValid := false
-	result := MainTokenStore.GetToken(string(tokenBuf))
+	result := MainTokenStore.GetToken(token)
 	if result != nil {
 		isTokenValid = true
 	}
@@ -71,7 +500,7 @@ func HandleLoginAction(conn *net.Conn) {
 
 func HandleRegisterAction(conn *net.Conn) {
 	token, err := GenerateToken(32)
-	MainTokenStore.AddToken(token, "")
+	MainTokenStore.AddToken(token, NewTokenInfo())
 	if err != nil {
 		utils.LogInfo("error generating token", err)
 		return
@@ -90,107 +519,326 @@ func HandleRegisterAction(conn *net.Conn) {
 	}
 }
 
-func HandleTunnelServer(conn *net.Conn) {
-	// token length
-	tokenLength, err := ReadUint32(*conn)
+// HandleTunnelServer sets up a tunnel, the capabilities agreed on in the
+// hello decide which of the requested features are used
+func HandleTunnelServer(conn *net.Conn, capabilities Capability) {
+	req, err := ReadTunnelRequest(*conn)
 	if err != nil {
-		utils.LogInfo("Failed to read token length", err)
+		utils.LogInfo("Failed to read tunnel request", err)
 		return
 	}
 
-	// token
-	tokenBuf, err := ReadIntoBuffer(*conn, tokenLength)
-	if err != nil {
-		utils.LogInfo("Failed to read token", err)
+	// validate token
+	result := MainTokenStore.GetToken(req.Token)
+	if result == nil {
+		refuseTunnel(conn, "Token is invalid", InvalidTokenError)
 		return
 	}
 
-	// validate token
-	isTokenValid := false
-	result := MainTokenStore.GetToken(string(tokenBuf))
-	if result != nil {
-		isTokenValid = true
+	if result.IsOverQuota() {
+		utils.LogInfo("Token is over its monthly quota", slog.Int64("quota", result.Quota()))
+		refuseTunnel(conn, "Token is over its monthly quota", QuotaExceededError)
+		return
 	}
 
-	if !isTokenValid {
-		utils.LogInfo("Token is invalid", err)
-		return
+	if req.ResumeToken != "" {
+		session, attachment, err := MainConnectionPooler.ResumeSession(req, conn)
+		if err == nil {
+			serveResumedTunnel(conn, session, attachment)
+			return
+		}
+
+		if !errors.Is(err, SessionNotFoundError) {
+			refuseTunnel(conn, "Failed to resume tunnel", err)
+			return
+		}
+
+		// the grace period is over, the tunnel is set up again below
 	}
 
-	// session id
-	sessionIDLength, err := ReadUint32(*conn)
-	if err != nil {
-		utils.LogInfo("Failed to read session id length", err)
+	subdomain := ""
+	switch {
+	case HasOwnPort(req.Protocol):
+		// tcp and udp tunnels are reached through their own port, not a subdomain
+	case req.Subdomain == "":
+		subdomain = pickRandomSubdomain()
+	default:
+		subdomain, err = ValidateSubdomain(req.Subdomain)
+		if err != nil {
+			refuseTunnel(conn, "Subdomain is invalid", err)
+			return
+		}
+	}
+
+	if !MainTokenStore.CanUseSubdomain(subdomain, req.Token) {
+		utils.LogInfo("Subdomain is reserved by another token", slog.String("subdomain", subdomain))
+		refuseTunnel(conn, "Subdomain is reserved", SubdomainReservedError)
 		return
 	}
 
-	// session string
-	sessionBuf, err := ReadIntoBuffer(*conn, sessionIDLength)
+	hostname := NormalizeHostname(req.Hostname)
+	if hostname != "" {
+		err = validateHostname(hostname, req.Protocol)
+		if err != nil {
+			refuseTunnel(conn, "Hostname is invalid", err)
+			return
+		}
+	}
+
+	ipRules, err := ParseIpRules(req.Allow, req.Deny)
 	if err != nil {
-		utils.LogInfo("Failed to read token", err)
+		refuseTunnel(conn, "Invalid ip rules", fmt.Errorf("%w: %w", InvalidIpRulesError, err))
 		return
 	}
-	sessionStr := string(sessionBuf)
 
-	// subdomain length
-	subdomainLength, err := ReadUint32(*conn)
-	if err != nil {
-		utils.LogInfo("Failed to read subdomain length", err)
+	if IsUdpProtocol(req.Protocol) && !capabilities.Has(UdpCapability) {
+		refuseTunnel(conn, "Udp tunnels were not agreed on", UnsupportedFeatureError)
 		return
 	}
 
-	// subdomain
-	subdomainBuf, err := ReadIntoBuffer(*conn, subdomainLength)
+	resumeToken, err := GenerateToken(32)
 	if err != nil {
-		utils.LogInfo("Failed to read token", err)
+		refuseTunnel(conn, "Failed to generate resume token", err)
 		return
 	}
-	subdomainStr := string(subdomainBuf)
 
-	_, err = MainConnectionPooler.AddSession(sessionStr, subdomainStr, conn)
-	defer MainConnectionPooler.RemoveSession(sessionStr)
+	options := &SessionOptions{
+		Protocol:    req.Protocol,
+		ForwardAddr: req.ForwardAddr && capabilities.Has(ForwardAddrCapability),
+		Http2:       req.Http2,
+		Group:       req.Group,
+		IpRules:     ipRules,
+		MaxConns:    MainConfig.NegotiateMaxConns(req.MaxConns),
+		ResumeToken: resumeToken,
+	}
 
+	session, err := MainConnectionPooler.AddSession(req.SessionID, subdomain, hostname, req.Token, options, conn)
 	if err != nil {
-		utils.LogInfo("Failed to start session", err)
+		refuseTunnel(conn, "Failed to start session", err)
 		return
 	}
 
+	// the claim is only taken once the session is in, a refused session
+	// would otherwise keep the hostname from its owner
+	if hostname != "" {
+		err = MainTokenStore.ClaimHostname(hostname, req.Token)
+		if err != nil {
+			MainConnectionPooler.RemoveSession(req.SessionID)
+			refuseTunnel(conn, "Failed to claim hostname", err)
+			return
+		}
+
+		defer MainTokenStore.ReleaseHostname(hostname, req.Token)
+	}
+
+	defer MainConnectionPooler.RemoveSession(req.SessionID)
+
+	defer func() {
+		utils.LogInfo("Tunnel closed",
+			slog.String("subdomain", session.Subdomain),
+			slog.Int64("bytesUp", session.BytesUp.Load()),
+			slog.Int64("bytesDown", session.BytesDown.Load()),
+		)
+	}()
+
+	resp := &TunnelResponse{
+		Success:     true,
+		MaxConns:    uint32(session.MaxConns),
+		Subdomain:   subdomain,
+		ResumeToken: resumeToken,
+	}
+	if IsTcpProtocol(req.Protocol) {
+		tcpServer, port, err := MainPortAllocator.Listen(func(c *net.Conn) {
+			TcpServerHandler(c, session)
+		})
+
+		if err != nil {
+			refuseTunnel(conn, "Failed to start tcp listener", err)
+			return
+		}
+
+		defer MainPortAllocator.Release(port)
+		defer tcpServer.Listener.Close()
+
+		go func() {
+			tcpServer.Start()
+		}()
+
+		session.Port = port
+		resp.Port = uint32(port)
+	}
+
+	if IsUdpProtocol(req.Protocol) {
+		udpConn, port, err := MainPortAllocator.ListenUdp()
+		if err != nil {
+			refuseTunnel(conn, "Failed to start udp listener", err)
+			return
+		}
+
+		defer MainPortAllocator.Release(port)
+		defer udpConn.Close()
+
+		relay := NewUdpRelay(udpConn, session)
+		go func() {
+			relay.Start()
+		}()
+
+		session.Port = port
+		resp.Port = uint32(port)
+	}
+
 	// write success
-	err = WriteBool(*conn, true)
+	err = WriteTunnelResponse(*conn, resp)
 	if err != nil {
 		utils.LogInfo("Failed to write success message", err)
 		return
 	}
 
+	// the session outlives its tunnel connection for the grace period so
+	// the client can come back to it
+	grace := MainConfig.ReconnectGrace
+	if !capabilities.Has(ResumeCapability) {
+		grace = 0
+	}
+
+	watchTunnel(conn)
+	for session.awaitResume(grace) {
+	}
+}
+
+// watchTunnel blocks until the tunnel connection dies
+func watchTunnel(conn *net.Conn) {
 	for {
-		// detect when connection dies
 		_, err := ReadIntoBuffer(*conn, 1)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				// connection is closed
-			}
-
-			break
+			return
 		}
 	}
 }
 
-func HandleJoinPool(conn *net.Conn) {
-	// session id length
-	sessionIDLength, err := ReadUint32(*conn)
+// serveResumedTunnel hands the tunnel connection of a resumed session over
+// to the handler owning the session and watches it until it drops
+func serveResumedTunnel(conn *net.Conn, session *Session, attachment *tunnelAttachment) {
+	defer close(attachment.done)
+
+	resp := &TunnelResponse{
+		Success:     true,
+		Port:        uint32(session.Port),
+		MaxConns:    uint32(session.MaxConns),
+		Subdomain:   session.Subdomain,
+		ResumeToken: session.ResumeToken,
+	}
+
+	err := WriteTunnelResponse(*conn, resp)
 	if err != nil {
-		utils.LogInfo("Failed to read session id length", err)
+		utils.LogInfo("Failed to write success message", err)
 		return
 	}
 
-	// session id
-	sessionIDBuf, err := ReadIntoBuffer(*conn, sessionIDLength)
+	session.attach(conn)
+	utils.LogInfo("Tunnel resumed", slog.String("subdomain", session.Subdomain))
+	watchTunnel(conn)
+}
+
+// refuseTunnel logs why a tunnel was refused and tells the client
+func refuseTunnel(conn *net.Conn, message string, err error) {
+	utils.LogInfo(message, slog.String("err", err.Error()))
+	err = WriteTunnelResponse(*conn, NewTunnelErrorResponse(err))
 	if err != nil {
-		utils.LogInfo("Failed to read token", err)
+		utils.LogInfo("Failed to write tunnel refusal", err)
+	}
+}
+
+// HandleReserveAction keeps a subdomain for the token, a subdomain served by
+// another token right now cannot be reserved. The client is answered with the
+// code of the refusal
+func HandleReserveAction(conn *net.Conn) {
+	req, err := ReadReservationRequest(*conn)
+	if err != nil {
+		utils.LogInfo("Failed to read reservation request", err)
 		return
 	}
 
-	sessionIDStr := string(sessionIDBuf)
+	err = reserveSubdomain(req.Subdomain, req.Token)
+	if err != nil {
+		utils.LogInfo("Failed to reserve subdomain", slog.String("subdomain", req.Subdomain), slog.String("err", err.Error()))
+	}
+
+	err = WriteUint32(*conn, uint32(TunnelErrorCodeOf(err)))
+	if err != nil {
+		utils.LogInfo("Failed to write reservation result", err)
+	}
+}
+
+func reserveSubdomain(subdomain, token string) error {
+	if MainTokenStore.GetToken(token) == nil {
+		return InvalidTokenError
+	}
+
+	subdomain, err := ValidateSubdomain(subdomain)
+	if err != nil {
+		return err
+	}
+
+	if MainConnectionPooler.IsSubdomainHeldByOther(subdomain, token) {
+		return SubdomainAlreadyExistsError
+	}
+
+	return MainTokenStore.ReserveSubdomain(subdomain, token)
+}
+
+func HandleReleaseAction(conn *net.Conn) {
+	req, err := ReadReservationRequest(*conn)
+	if err != nil {
+		utils.LogInfo("Failed to read reservation request", err)
+		return
+	}
+
+	subdomain := NormalizeHostname(req.Subdomain)
+	err = MainTokenStore.ReleaseSubdomain(subdomain, req.Token)
+	if err != nil {
+		utils.LogInfo("Failed to release subdomain", slog.String("subdomain", subdomain), slog.String("err", err.Error()))
+	}
+
+	err = WriteUint32(*conn, uint32(TunnelErrorCodeOf(err)))
+	if err != nil {
+		utils.LogInfo("Failed to write release result", err)
+	}
+}
+
+// validateHostname checks that a custom domain is made of dns labels,
+// hostnames under the base domain have to be requested as subdomains instead
+// and tunnels with their own port cannot be reached through one
+func validateHostname(hostname, protocol string) error {
+	if HasOwnPort(protocol) || len(hostname) > MaxHostnameLength {
+		return InvalidHostnameError
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return InvalidHostnameError
+	}
+
+	for _, label := range labels {
+		if !isDnsLabel(label) {
+			return InvalidHostnameError
+		}
+	}
+
+	if MainConfig.IsBaseDomainHost(hostname) {
+		return InvalidHostnameError
+	}
+
+	return nil
+}
+
+func HandleJoinPool(conn *net.Conn) {
+	// session id
+	sessionIDStr, err := ReadString(*conn)
+	if err != nil {
+		utils.LogInfo("Failed to read session id", err)
+		return
+	}
 
 	// verify session id
 	hasSession := MainConnectionPooler.HasSession(sessionIDStr)
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTunnelRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *TunnelRequest
+	}{
+		{"empty", &TunnelRequest{Allow: []string{}, Deny: []string{}}},
+		{"http", &TunnelRequest{
+			Token:     "LN97ccrfGrZX4rtiATmdDKImbQnbMW8BYWBWVrnfQpw=",
+			SessionID: "5f0c2b9e-session",
+			Subdomain: "brave-otter-42",
+			Protocol:  "https",
+			Hostname:  "demo.example.com",
+			Group:     true,
+			Allow:     []string{"10.0.0.0/8", "2001:db8::/32"},
+			Deny:      []string{"10.0.0.5"},
+			MaxConns:  20,
+			Http2:     true,
+		}},
+		{"tcp resume", &TunnelRequest{
+			Token:       "token",
+			SessionID:   "session",
+			Protocol:    "tcp",
+			ForwardAddr: true,
+			Allow:       []string{},
+			Deny:        []string{},
+			ResumeToken: "resume-token",
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteTunnelRequest(&buffer, tc.req); err != nil {
+				t.Fatalf("WriteTunnelRequest: %v", err)
+			}
+
+			encoded := buffer.Bytes()
+			req, err := ReadTunnelRequest(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("ReadTunnelRequest: %v", err)
+			}
+
+			if !reflect.DeepEqual(req, tc.req) {
+				t.Errorf("ReadTunnelRequest = %+v, want %+v", req, tc.req)
+			}
+
+			assertTruncationFails(t, encoded, func(r io.Reader) error {
+				_, err := ReadTunnelRequest(r)
+				return err
+			})
+		})
+	}
+}
+
+func TestTunnelResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *TunnelResponse
+	}{
+		{"http", &TunnelResponse{Success: true, MaxConns: 20, Subdomain: "brave-otter-42", ResumeToken: "resume-token"}},
+		{"tcp", &TunnelResponse{Success: true, Port: 40123, MaxConns: 5, ResumeToken: "resume-token"}},
+		{"refused", NewTunnelErrorResponse(BlockedSubdomainError)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteTunnelResponse(&buffer, tc.resp); err != nil {
+				t.Fatalf("WriteTunnelResponse: %v", err)
+			}
+
+			encoded := buffer.Bytes()
+			resp, err := ReadTunnelResponse(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("ReadTunnelResponse: %v", err)
+			}
+
+			if !reflect.DeepEqual(resp, tc.resp) {
+				t.Errorf("ReadTunnelResponse = %+v, want %+v", resp, tc.resp)
+			}
+
+			assertTruncationFails(t, encoded, func(r io.Reader) error {
+				_, err := ReadTunnelResponse(r)
+				return err
+			})
+		})
+	}
+}
+
+func TestTunnelResponseErr(t *testing.T) {
+	if err := (&TunnelResponse{Success: true}).Err(); err != nil {
+		t.Errorf("Err() = %v for a successful response", err)
+	}
+
+	err := NewTunnelErrorResponse(HostnameClaimedError).Err()
+	var refused *TunnelRefusedError
+	if !errors.As(err, &refused) || refused.Code != HostnameTakenCode || refused.Message != HostnameClaimedError.Error() {
+		t.Errorf("Err() = %#v", err)
+	}
+}
+
+func TestTunnelErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		code TunnelErrorCode
+	}{
+		{nil, NoErrorCode},
+		{InvalidTokenError, InvalidTokenCode},
+		{BlockedSubdomainError, BlockedSubdomainCode},
+		{SubdomainReservedError, SubdomainTakenCode},
+		{SubdomainNotReservedError, SubdomainNotReservedCode},
+		{HostnameAlreadyExistsError, HostnameTakenCode},
+		{errors.Join(InvalidIpRulesError, errors.New("invalid cidr")), InvalidIpRulesCode},
+		{errors.New("anything else"), InternalErrorCode},
+	}
+
+	for _, tc := range tests {
+		if code := TunnelErrorCodeOf(tc.err); code != tc.code {
+			t.Errorf("TunnelErrorCodeOf(%v) = %d, want %d", tc.err, code, tc.code)
+		}
+	}
+}
+
+func TestReadStringLimits(t *testing.T) {
+	var buffer bytes.Buffer
+	WriteString(&buffer, strings.Repeat("x", MaxStringLength+1))
+	if _, err := ReadString(&buffer); err != StringTooLongError {
+		t.Errorf("ReadString of a long string = %v, want %v", err, StringTooLongError)
+	}
+
+	buffer.Reset()
+	WriteStringList(&buffer, make([]string, MaxStringListLength+1))
+	if _, err := ReadStringList(&buffer); err != StringListTooLongError {
+		t.Errorf("ReadStringList of a long list = %v, want %v", err, StringListTooLongError)
+	}
+}
+
+// assertTruncationFails checks that every cut short message fails to read
+func assertTruncationFails(t *testing.T, encoded []byte, read func(io.Reader) error) {
+	t.Helper()
+
+	for i := range encoded {
+		if err := read(bytes.NewReader(encoded[:i])); err == nil {
+			t.Errorf("reading the first %d of %d bytes: no error", i, len(encoded))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/samuelships/harlot/utils"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// MinShaperBurst keeps small rates from writing a few bytes at a time
+	MinShaperBurst = 16 * 1024
+)
+
+var (
+	QuotaExceededError = errors.New("Monthly transfer quota exceeded")
+)
+
+// Direction of traffic through a tunnel, up is from public peers to the
+// local service and down is back to the peers
+type Direction int
+
+const (
+	Upstream Direction = iota
+	Downstream
+)
+
+// TokenUsage counts the bytes a token moved in the current month
+type TokenUsage struct {
+	Month     string
+	BytesUp   int64
+	BytesDown int64
+	Mu        sync.Mutex
+}
+
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// resetIfNewMonth has to be called with the lock held
+func (u *TokenUsage) resetIfNewMonth() {
+	if month := currentMonth(); u.Month != month {
+		u.Month = month
+		u.BytesUp = 0
+		u.BytesDown = 0
+	}
+}
+
+func (u *TokenUsage) Add(direction Direction, n int64) {
+	u.Mu.Lock()
+	defer u.Mu.Unlock()
+	u.resetIfNewMonth()
+
+	if direction == Upstream {
+		u.BytesUp += n
+	} else {
+		u.BytesDown += n
+	}
+}
+
+func (u *TokenUsage) Total() int64 {
+	u.Mu.Lock()
+	defer u.Mu.Unlock()
+	u.resetIfNewMonth()
+	return u.BytesUp + u.BytesDown
+}
+
+// TrafficShaper hands out byte rate limiters per token, so the tunnels of
+// one token share its bandwidth. A zero rate is unlimited
+type TrafficShaper struct {
+	Up       rate.Limit
+	Down     rate.Limit
+	Limiters map[string][2]*rate.Limiter
+	Mu       sync.Mutex
+}
+
+var MainTrafficShaper = NewTrafficShaper(0, 0)
+
+func NewTrafficShaper(upBytesPerSec, downBytesPerSec int64) *TrafficShaper {
+	return &TrafficShaper{
+		Up:       rate.Limit(upBytesPerSec),
+		Down:     rate.Limit(downBytesPerSec),
+		Limiters: map[string][2]*rate.Limiter{},
+	}
+}
+
+func newByteLimiter(limit rate.Limit) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(limit, max(int(limit), MinShaperBurst))
+}
+
+// Limiter returns the token's limiter for a direction, nil when unlimited
+func (ts *TrafficShaper) Limiter(token string, direction Direction) *rate.Limiter {
+	ts.Mu.Lock()
+	defer ts.Mu.Unlock()
+
+	limiters, ok := ts.Limiters[token]
+	if !ok {
+		limiters = [2]*rate.Limiter{newByteLimiter(ts.Up), newByteLimiter(ts.Down)}
+		ts.Limiters[token] = limiters
+	}
+
+	return limiters[direction]
+}
+
+// meteredWriter counts, shapes and enforces the quota of the bytes written
+// through a tunnel
+type meteredWriter struct {
+	writer    io.Writer
+	session   *Session
+	token     *TokenInfo
+	limiter   *rate.Limiter
+	direction Direction
+}
+
+func newMeteredWriter(writer io.Writer, session *Session, direction Direction) *meteredWriter {
+	return &meteredWriter{
+		writer:    writer,
+		session:   session,
+		token:     MainTokenStore.GetToken(session.Token),
+		limiter:   MainTrafficShaper.Limiter(session.Token, direction),
+		direction: direction,
+	}
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if w.limiter != nil && len(chunk) > w.limiter.Burst() {
+			chunk = chunk[:w.limiter.Burst()]
+		}
+
+		err := w.take(len(chunk))
+		if err != nil {
+			return written, err
+		}
+
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// take waits until n bytes may pass and counts them, it fails once the
+// token is over its monthly quota
+func (w *meteredWriter) take(n int) error {
+	if w.token != nil && w.token.IsOverQuota() {
+		utils.LogInfo("Closing connection over quota", slog.String("subdomain", w.session.Subdomain))
+		return QuotaExceededError
+	}
+
+	if w.limiter != nil {
+		err := w.limiter.WaitN(context.Background(), n)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.direction == Upstream {
+		w.session.BytesUp.Add(int64(n))
+	} else {
+		w.session.BytesDown.Add(int64(n))
+	}
+
+	if w.token != nil {
+		w.token.Usage.Add(w.direction, int64(n))
+	}
+
+	return nil
+}
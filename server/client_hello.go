@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	// MaxClientHelloBytes bounds the records peeked for a ClientHello, the
+	// public reader has to be at least this large
+	MaxClientHelloBytes = 32 * 1024
+	// MaxTlsRecordLength is the largest plaintext fragment of a record
+	MaxTlsRecordLength = 16 * 1024
+
+	tlsRecordHeaderLength     = 5
+	tlsRecordTypeHandshake    = 0x16
+	tlsHandshakeClientHello   = 0x01
+	tlsHandshakeHeaderLength  = 4
+	tlsExtServerName          = 0
+	tlsExtAlpn                = 16
+	tlsExtSupportedVersions   = 43
+	tlsServerNameTypeHostName = 0
+)
+
+var (
+	NotTlsHandshakeError       = errors.New("Not a tls handshake record")
+	UnsupportedTlsVersionError = errors.New("Unsupported tls record version")
+	NotClientHelloError        = errors.New("Not a client hello")
+	MalformedClientHelloError  = errors.New("Malformed client hello")
+	ClientHelloTooLargeError   = errors.New("Client hello too large")
+)
+
+// ClientHello is what the public server reads from the start of a tls
+// connection before deciding where it goes
+type ClientHello struct {
+	ServerName string
+	// Alpn are the application protocols offered, e.g. h2 and http/1.1
+	Alpn []string
+	// SupportedVersions are the tls versions offered by tls 1.3 clients
+	SupportedVersions []uint16
+}
+
+// ReadSNIFromClientHello peeks at the server name of a tls connection, it
+// is empty when the client sent none
+func ReadSNIFromClientHello(peakReader *bufio.Reader) (string, error) {
+	hello, err := PeekClientHello(peakReader)
+	if err != nil {
+		return "", err
+	}
+
+	return hello.ServerName, nil
+}
+
+// PeekClientHello reads the ClientHello at the start of a tls connection
+// without consuming it, the message may be split across several records
+func PeekClientHello(peakReader *bufio.Reader) (*ClientHello, error) {
+	message := []byte{}
+	offset := 0
+
+	for {
+		header, err := peakReader.Peek(offset + tlsRecordHeaderLength)
+		if err != nil {
+			return nil, err
+		}
+
+		header = header[offset:]
+		if header[0] != tlsRecordTypeHandshake {
+			return nil, NotTlsHandshakeError
+		}
+
+		version := uint16(header[1])<<8 | uint16(header[2])
+		if version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+			return nil, UnsupportedTlsVersionError
+		}
+
+		length := int(header[3])<<8 | int(header[4])
+		if length == 0 || length > MaxTlsRecordLength {
+			return nil, MalformedClientHelloError
+		}
+
+		end := offset + tlsRecordHeaderLength + length
+		if end > MaxClientHelloBytes || end > peakReader.Size() {
+			return nil, ClientHelloTooLargeError
+		}
+
+		record, err := peakReader.Peek(end)
+		if err != nil {
+			return nil, err
+		}
+
+		message = append(message, record[offset+tlsRecordHeaderLength:]...)
+		offset = end
+
+		if len(message) < tlsHandshakeHeaderLength {
+			continue
+		}
+
+		if message[0] != tlsHandshakeClientHello {
+			return nil, NotClientHelloError
+		}
+
+		total := tlsHandshakeHeaderLength + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+		if total > MaxClientHelloBytes {
+			return nil, ClientHelloTooLargeError
+		}
+
+		if len(message) >= total {
+			return ParseClientHello(message[:total])
+		}
+	}
+}
+
+// ParseClientHello parses a whole ClientHello handshake message, the
+// extensions that are not needed are skipped
+func ParseClientHello(message []byte) (*ClientHello, error) {
+	input := cryptobyte.String(message)
+
+	var msgType uint8
+	if !input.ReadUint8(&msgType) || msgType != tlsHandshakeClientHello {
+		return nil, NotClientHelloError
+	}
+
+	var body cryptobyte.String
+	if !input.ReadUint24LengthPrefixed(&body) || !input.Empty() {
+		return nil, MalformedClientHelloError
+	}
+
+	// legacy version, random, session id, cipher suites and compression
+	var sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !body.Skip(2+32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, MalformedClientHelloError
+	}
+
+	hello := &ClientHello{}
+
+	// the extensions block is optional
+	if body.Empty() {
+		return hello, nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return nil, MalformedClientHelloError
+	}
+
+	seen := map[uint16]bool{}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, MalformedClientHelloError
+		}
+
+		if seen[extType] {
+			return nil, MalformedClientHelloError
+		}
+
+		seen[extType] = true
+
+		var err error
+		switch extType {
+		case tlsExtServerName:
+			hello.ServerName, err = parseServerNameExtension(extData)
+		case tlsExtAlpn:
+			hello.Alpn, err = parseAlpnExtension(extData)
+		case tlsExtSupportedVersions:
+			hello.SupportedVersions, err = parseSupportedVersionsExtension(extData)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// parseServerNameExtension returns the first host_name entry, other name
+// types are skipped
+func parseServerNameExtension(data cryptobyte.String) (string, error) {
+	var names cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&names) || !data.Empty() {
+		return "", MalformedClientHelloError
+	}
+
+	serverName := ""
+	for !names.Empty() {
+		var nameType uint8
+		var name cryptobyte.String
+		if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+			return "", MalformedClientHelloError
+		}
+
+		if nameType == tlsServerNameTypeHostName && serverName == "" {
+			if len(name) == 0 {
+				return "", MalformedClientHelloError
+			}
+
+			serverName = string(name)
+		}
+	}
+
+	return serverName, nil
+}
+
+func parseAlpnExtension(data cryptobyte.String) ([]string, error) {
+	var protocols cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&protocols) || !data.Empty() {
+		return nil, MalformedClientHelloError
+	}
+
+	alpn := []string{}
+	for !protocols.Empty() {
+		var protocol cryptobyte.String
+		if !protocols.ReadUint8LengthPrefixed(&protocol) || len(protocol) == 0 {
+			return nil, MalformedClientHelloError
+		}
+
+		alpn = append(alpn, string(protocol))
+	}
+
+	return alpn, nil
+}
+
+func parseSupportedVersionsExtension(data cryptobyte.String) ([]uint16, error) {
+	var list cryptobyte.String
+	if !data.ReadUint8LengthPrefixed(&list) || !data.Empty() {
+		return nil, MalformedClientHelloError
+	}
+
+	versions := []uint16{}
+	for !list.Empty() {
+		var version uint16
+		if !list.ReadUint16(&version) {
+			return nil, MalformedClientHelloError
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// captureClientHello returns the records crypto/tls sends to open a handshake
+func captureClientHello(t testing.TB, config *tls.Config) []byte {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		tls.Client(clientConn, config).Handshake()
+		clientConn.Close()
+	}()
+
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, tlsRecordHeaderLength)
+	if _, err := readFull(serverConn, header); err != nil {
+		t.Fatalf("reading record header: %v", err)
+	}
+
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := readFull(serverConn, body); err != nil {
+		t.Fatalf("reading record body: %v", err)
+	}
+
+	return append(header, body...)
+}
+
+func readFull(conn net.Conn, buffer []byte) (int, error) {
+	read := 0
+	for read < len(buffer) {
+		n, err := conn.Read(buffer[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// splitRecords moves the handshake message of a single record into records
+// of at most size bytes with the given record version
+func splitRecords(record []byte, size int, version uint16) []byte {
+	message := record[tlsRecordHeaderLength:]
+	out := []byte{}
+	for len(message) > 0 {
+		n := min(size, len(message))
+		out = append(out, tlsRecordTypeHandshake, byte(version>>8), byte(version), byte(n>>8), byte(n))
+		out = append(out, message[:n]...)
+		message = message[n:]
+	}
+
+	return out
+}
+
+// buildClientHello builds a ClientHello record by hand, extensions is nil to
+// leave the extensions block out
+func buildClientHello(extensions func(*cryptobyte.Builder)) []byte {
+	var body cryptobyte.Builder
+	body.AddUint16(tls.VersionTLS12)
+	body.AddBytes(make([]byte, 32))
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	body.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	})
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0)
+	})
+
+	if extensions != nil {
+		body.AddUint16LengthPrefixed(extensions)
+	}
+
+	var message cryptobyte.Builder
+	message.AddUint8(tlsHandshakeClientHello)
+	message.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(body.BytesOrPanic())
+	})
+
+	var record cryptobyte.Builder
+	record.AddUint8(tlsRecordTypeHandshake)
+	record.AddUint16(tls.VersionTLS10)
+	record.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(message.BytesOrPanic())
+	})
+
+	return record.BytesOrPanic()
+}
+
+// serverNameListHello carries a server_name list whose first entry is not a
+// host_name
+func serverNameListHello() []byte {
+	return buildClientHello(func(b *cryptobyte.Builder) {
+		b.AddUint16(tlsExtServerName)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(1)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte("not-a-host-name"))
+				})
+				b.AddUint8(tlsServerNameTypeHostName)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte("listed.harlot.test"))
+				})
+			})
+		})
+	})
+}
+
+type clientHelloCase struct {
+	name  string
+	data  []byte
+	hello *ClientHello
+}
+
+func clientHelloCases(t testing.TB) []clientHelloCase {
+	tls13 := captureClientHello(t, &tls.Config{
+		ServerName: "app.harlot.test",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	tls12 := captureClientHello(t, &tls.Config{
+		ServerName: "old.harlot.test",
+		MaxVersion: tls.VersionTLS12,
+	})
+
+	modern := &ClientHello{
+		ServerName:        "app.harlot.test",
+		Alpn:              []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+
+	return []clientHelloCase{
+		{"single record", tls13, modern},
+		{"record version 0x0301", splitRecords(tls13, len(tls13), tls.VersionTLS10), modern},
+		{"record version 0x0303", splitRecords(tls13, len(tls13), tls.VersionTLS12), modern},
+		{"split across records", splitRecords(tls13, 64, tls.VersionTLS12), modern},
+		{"one byte records", splitRecords(tls13, 1, tls.VersionTLS10), modern},
+		{"tls 1.2 client", tls12, &ClientHello{ServerName: "old.harlot.test", SupportedVersions: []uint16{tls.VersionTLS12}}},
+		{"first server name is not host_name", serverNameListHello(), &ClientHello{ServerName: "listed.harlot.test"}},
+		{"no extensions", buildClientHello(nil), &ClientHello{}},
+	}
+}
+
+func peekClientHello(data []byte) (*ClientHello, error) {
+	return PeekClientHello(bufio.NewReaderSize(bytes.NewReader(data), MaxClientHelloBytes))
+}
+
+func TestPeekClientHello(t *testing.T) {
+	for _, tc := range clientHelloCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			hello, err := peekClientHello(tc.data)
+			if err != nil {
+				t.Fatalf("PeekClientHello: %v", err)
+			}
+
+			if hello.ServerName != tc.hello.ServerName {
+				t.Errorf("ServerName = %q, want %q", hello.ServerName, tc.hello.ServerName)
+			}
+
+			if len(hello.Alpn) != 0 || len(tc.hello.Alpn) != 0 {
+				if !reflect.DeepEqual(hello.Alpn, tc.hello.Alpn) {
+					t.Errorf("Alpn = %q, want %q", hello.Alpn, tc.hello.Alpn)
+				}
+			}
+
+			if len(hello.SupportedVersions) != 0 || len(tc.hello.SupportedVersions) != 0 {
+				if !reflect.DeepEqual(hello.SupportedVersions, tc.hello.SupportedVersions) {
+					t.Errorf("SupportedVersions = %x, want %x", hello.SupportedVersions, tc.hello.SupportedVersions)
+				}
+			}
+		})
+	}
+}
+
+func TestPeekClientHelloRejects(t *testing.T) {
+	valid := buildClientHello(nil)
+
+	wrongType := append([]byte{}, valid...)
+	wrongType[0] = 0x17
+
+	sslv3 := append([]byte{}, valid...)
+	sslv3[2] = 0x00
+
+	serverHello := append([]byte{}, valid...)
+	serverHello[tlsRecordHeaderLength] = 0x02
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"application data record", wrongType, NotTlsHandshakeError},
+		{"ssl 3.0 record", sslv3, UnsupportedTlsVersionError},
+		{"server hello", serverHello, NotClientHelloError},
+		{"empty record", []byte{tlsRecordTypeHandshake, 3, 1, 0, 0}, MalformedClientHelloError},
+		{"plain http", []byte("GET / HTTP/1.1\r\n\r\n"), NotTlsHandshakeError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := peekClientHello(tc.data)
+			if err != tc.err {
+				t.Errorf("err = %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	// every truncation fails cleanly
+	for i := range valid {
+		if _, err := peekClientHello(valid[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", i)
+		}
+	}
+}
+
+func TestReadSNIFromClientHello(t *testing.T) {
+	record := captureClientHello(t, &tls.Config{ServerName: "sni.harlot.test"})
+	name, err := ReadSNIFromClientHello(bufio.NewReaderSize(bytes.NewReader(record), MaxClientHelloBytes))
+	if err != nil || name != "sni.harlot.test" {
+		t.Errorf("ReadSNIFromClientHello = %q, %v", name, err)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	for _, tc := range clientHelloCases(f) {
+		f.Add(reassemble(tc.data))
+	}
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		hello, err := ParseClientHello(message)
+		if err == nil && hello == nil {
+			t.Fatal("nil hello without an error")
+		}
+	})
+}
+
+func FuzzPeekClientHello(f *testing.F) {
+	for _, tc := range clientHelloCases(f) {
+		f.Add(tc.data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, err := peekClientHello(data)
+		if err != nil {
+			return
+		}
+
+		if hello == nil {
+			t.Fatal("nil hello without an error")
+		}
+
+		// whatever was peeked parses the same from the bare message
+		again, err := ParseClientHello(reassemble(data))
+		if err != nil || !reflect.DeepEqual(hello, again) {
+			t.Fatalf("ParseClientHello disagrees: %+v %v, peeked %+v", again, err, hello)
+		}
+	})
+}
+
+// reassemble joins the fragments of the leading handshake records into the
+// handshake message they carry
+func reassemble(data []byte) []byte {
+	message := []byte{}
+	for len(data) >= tlsRecordHeaderLength && data[0] == tlsRecordTypeHandshake {
+		length := int(data[3])<<8 | int(data[4])
+		if len(data) < tlsRecordHeaderLength+length {
+			break
+		}
+
+		message = append(message, data[tlsRecordHeaderLength:tlsRecordHeaderLength+length]...)
+		data = data[tlsRecordHeaderLength+length:]
+
+		if len(message) >= tlsHandshakeHeaderLength {
+			total := tlsHandshakeHeaderLength + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+			if len(message) >= total {
+				return message[:total]
+			}
+		}
+	}
+
+	return message
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type TlsMode string
+
+const (
+	// PassthroughTlsMode forwards public tls untouched, clients terminate it
+	PassthroughTlsMode TlsMode = "passthrough"
+	// EdgeTlsMode terminates public tls on the server and forwards plaintext
+	// over the (already encrypted) pool connection
+	EdgeTlsMode TlsMode = "edge"
+)
+
+type LoadBalancing string
+
+const (
+	RoundRobinLoadBalancing LoadBalancing = "roundrobin"
+	LeastConnLoadBalancing  LoadBalancing = "leastconn"
+)
+
+const (
+	DefaultMaxConns      = 100
+	DefaultConnQueueSize = 100
+	// DefaultReconnectGrace covers a wifi blip or a laptop waking up
+	DefaultReconnectGrace = 30 * time.Second
+)
+
+var MainConfig = NewConfig()
+
+type Config struct {
+	// BaseDomain is the domain tunnels get subdomains under
+	BaseDomain string
+	// BlockedSubdomains can neither be tunneled on nor reserved
+	BlockedSubdomains []string
+	// BlockedWords may not appear as a word of any subdomain
+	BlockedWords []string
+
+	TlsMode  TlsMode
+	CertFile string
+	KeyFile  string
+
+	// PublicTlsConfig is loaded once at startup, it terminates public tls in
+	// edge mode and for error pages
+	PublicTlsConfig *tls.Config
+
+	// ErrorPageFormat is how errors are shown to public http clients
+	ErrorPageFormat ErrorPageFormat
+
+	AcmeDirectoryURL string
+	AcmeCacheDir     string
+	AcmeEmail        string
+	AcmeCAFile       string
+	// AcmeHosts are the server's own hostnames that always get a certificate
+	AcmeHosts []string
+
+	// LoadBalancing picks a session when a group shares a subdomain
+	LoadBalancing LoadBalancing
+
+	// MaxConns is the most connections a tunnel may have open at once, it
+	// is the default and the cap of what clients ask for
+	MaxConns int
+	// ConnQueueSize public connections may wait ConnQueueTimeout for a
+	// tunnel that is at its limit
+	ConnQueueSize    int
+	ConnQueueTimeout time.Duration
+
+	// ReconnectGrace is how long a tunnel whose client dropped keeps its
+	// subdomain and port for that client, 0 frees them right away
+	ReconnectGrace time.Duration
+
+	// MonthlyQuota is the default transfer quota of a token in bytes, 0 is
+	// unlimited
+	MonthlyQuota int64
+
+	// UdpIdleTimeout is how long a udp peer may stay quiet before its flow
+	// is torn down
+	UdpIdleTimeout time.Duration
+}
+
+// EdgeTlsConfig terminates public tls of a tunnel in edge mode. The client
+// relays h2 as is, so it is only offered to tunnels that asked for it and
+// everyone else is held to http/1.1, whatever the certificate source offers
+func (c *Config) EdgeTlsConfig(http2 bool) *tls.Config {
+	config := c.PublicTlsConfig.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	if http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if MainCertManager != nil {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+
+	return config
+}
+
+// IsBaseDomainHost reports whether the host is the base domain or under it
+func (c *Config) IsBaseDomainHost(host string) bool {
+	return host == c.BaseDomain || strings.HasSuffix(host, "."+c.BaseDomain)
+}
+
+// SubdomainOf returns the part of the host in front of the base domain
+func (c *Config) SubdomainOf(host string) (string, bool) {
+	subdomain, found := strings.CutSuffix(host, "."+c.BaseDomain)
+	if !found || subdomain == "" {
+		return "", false
+	}
+
+	return subdomain, true
+}
+
+// IsAcmeHost reports whether the host is one of the server's own, the base
+// domain always is since clients reach the private server through it
+func (c *Config) IsAcmeHost(host string) bool {
+	if strings.EqualFold(c.BaseDomain, host) {
+		return true
+	}
+
+	for _, acmeHost := range c.AcmeHosts {
+		if strings.EqualFold(acmeHost, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NegotiateMaxConns settles the connection limit of a tunnel, clients may
+// ask for less than the server allows but never more
+func (c *Config) NegotiateMaxConns(requested uint32) int {
+	if requested == 0 || int64(requested) > int64(c.MaxConns) {
+		return c.MaxConns
+	}
+
+	return int(requested)
+}
+
+func NewConfig() *Config {
+	return &Config{
+		BaseDomain:        "harlot.app",
+		BlockedSubdomains: DefaultBlockedSubdomains,
+		BlockedWords:      DefaultBlockedWords,
+		TlsMode:           PassthroughTlsMode,
+		CertFile:          "serverCert.pem",
+		KeyFile:           "serverKey.pem",
+
+		AcmeDirectoryURL: autocert.DefaultACMEDirectory,
+		AcmeCacheDir:     "certs",
+
+		ErrorPageFormat: HtmlErrorPageFormat,
+		LoadBalancing:   RoundRobinLoadBalancing,
+		UdpIdleTimeout:  1 * time.Minute,
+
+		MaxConns:         DefaultMaxConns,
+		ConnQueueSize:    DefaultConnQueueSize,
+		ConnQueueTimeout: ConnectionGetWaitTimeoutSecs * time.Second,
+		ReconnectGrace:   DefaultReconnectGrace,
+	}
+}
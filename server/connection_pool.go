@@ -1,46 +1,134 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	MAX_CHAN_SIZE = 99999
+	ConnRequestRetry = 100 * time.Millisecond
+	// ConnRequestTimeout is how long requested connections are waited for
+	// before the client is asked for them again, a client at its own limit
+	// drops requests until one of its workers is done
+	ConnRequestTimeout = 500 * time.Millisecond
 )
 
 var (
-	PoolFullError        = errors.New("Pool is full")
-	PoolEmptyError       = errors.New("Pool is empty")
-	SessionNotFoundError = errors.New("Session not found")
-	SubdomainNotFoundError = errors.New("Subdomain not found")
+	PoolFullError               = errors.New("Pool is full")
+	PoolEmptyError              = errors.New("Pool is empty")
+	SessionNotFoundError        = errors.New("Session not found")
+	SessionAlreadyExistsError   = errors.New("Session already exists")
+	SubdomainNotFoundError      = errors.New("Subdomain not found")
 	SubdomainAlreadyExistsError = errors.New("Subdomain already exists")
+	HostnameNotFoundError       = errors.New("Hostname not found")
+	HostnameAlreadyExistsError  = errors.New("Hostname already exists")
+	TunnelBusyError             = errors.New("Tunnel busy")
 )
 
 type Conn struct {
 	SessionID string
 	Conn      *net.Conn
 	StartTime time.Time
-	Done chan struct{}
+	Done      chan struct{}
 }
 
 type Session struct {
-	SessionID   string
-	Subdomain   string
+	SessionID string
+	Subdomain string
+	Hostname  string
+	Token     string
+	// TunnelConn is nil while the client is away during the grace period
 	TunnelConn  *net.Conn
+	Port        int
+	Protocol    string
+	ForwardAddr bool
+	// Http2 offers h2 to public clients when tls is terminated at the edge
+	Http2 bool
+	// Group sessions may share their subdomain with other group sessions
+	// of the same token
+	Group bool
+	// IpRules decide which public peers may reach the session
+	IpRules     *IpRules
+	ActiveConns atomic.Int64
+	// bytes from and to public peers
+	BytesUp   atomic.Int64
+	BytesDown atomic.Int64
+	// MaxConns bounds the pool connections of the session, busy and idle
+	MaxConns    int
 	Connections chan *Conn
 	ConnMu      sync.Mutex
-	NextOpen    int
-	done        chan struct{}
+	// Pending counts the connections asked of the client that did not join
+	// yet, the request is given up on at PendingExpiry
+	Pending       int
+	PendingExpiry time.Time
+	// connWaiters counts the public connections waiting for a pool
+	// connection
+	connWaiters int
+	// slots holds one entry per public connection being served, Waiting
+	// counts the ones queued for a free slot
+	slots   chan struct{}
+	Waiting atomic.Int64
+	done    chan struct{}
+	// ResumeToken lets the client reattach after its tunnel connection
+	// dropped, resumes hands the new connection to the session's owner
+	ResumeToken string
+	resumes     chan *tunnelAttachment
+}
+
+// AcquireSlot waits in the session's queue for a free connection slot,
+// blocked senders on a channel are woken in order so the queue is fifo
+func (s *Session) AcquireSlot(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if s.Waiting.Add(1) > int64(MainConfig.ConnQueueSize) {
+		s.Waiting.Add(-1)
+		return TunnelBusyError
+	}
+
+	defer s.Waiting.Add(-1)
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-s.done:
+		return TunnelOfflineError
+	case <-ctx.Done():
+		return UpstreamTimeoutError
+	}
+}
+
+func (s *Session) ReleaseSlot() {
+	<-s.slots
+}
+
+// SessionOptions are the per tunnel settings asked for by the client
+type SessionOptions struct {
+	Protocol    string
+	ForwardAddr bool
+	Http2       bool
+	Group       bool
+	IpRules     *IpRules
+	MaxConns    int
+	ResumeToken string
 }
 
 type ConnectionPooler struct {
 	Sessions           map[string]*Session
-	SubdomainToSession map[string]*Session
-	SessMu             sync.Mutex
-	IdleTimeout        time.Duration
+	SubdomainToSession map[string][]*Session
+	HostnameToSession  map[string][]*Session
+	// round robin position per subdomain / hostname
+	SubdomainNext map[string]uint64
+	HostnameNext  map[string]uint64
+	SessMu        sync.Mutex
+	IdleTimeout   time.Duration
 }
 
 func (cp *ConnectionPooler) IsSessionInPool(sessionID string) bool {
@@ -57,12 +145,65 @@ func (cp *ConnectionPooler) IsSubdomainInPool(subdomain string) bool {
 	return ok
 }
 
+// IsSubdomainHeldByOther reports whether sessions of another token are
+// serving the subdomain
+func (cp *ConnectionPooler) IsSubdomainHeldByOther(subdomain, token string) bool {
+	cp.SessMu.Lock()
+	defer cp.SessMu.Unlock()
+
+	for _, session := range cp.SubdomainToSession[subdomain] {
+		if session.Token != token {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (cp *ConnectionPooler) Start() {
 	go func() {
 		cp.StartPrunner()
 	}()
 }
 
+// WaitConn takes an idle connection of the session, the client is asked
+// for the missing ones when none is left. Requests unanswered after
+// ConnRequestTimeout are made again, the client may have been reconnecting
+func (cp *ConnectionPooler) WaitConn(ctx context.Context, session *Session) (*Conn, error) {
+	select {
+	case c := <-session.Connections:
+		return c, nil
+	default:
+	}
+
+	session.addConnWaiter(1)
+	defer session.addConnWaiter(-1)
+
+	ticker := time.NewTicker(ConnRequestRetry)
+	defer ticker.Stop()
+
+	for {
+		err := cp.OpenMoreConns(session)
+		if err != nil {
+			return nil, TunnelOfflineError
+		}
+
+		select {
+		case c := <-session.Connections:
+			return c, nil
+		case <-session.done:
+			return nil, TunnelOfflineError
+		case <-ctx.Done():
+			if session.IsDetached() {
+				return nil, TunnelOfflineError
+			}
+
+			return nil, UpstreamTimeoutError
+		case <-ticker.C:
+		}
+	}
+}
+
 func (cp *ConnectionPooler) GetConn(sessionID string) (*Conn, error) {
 	if !cp.IsSessionInPool(sessionID) {
 		return nil, SessionNotFoundError
@@ -80,25 +221,131 @@ func (cp *ConnectionPooler) GetConn(sessionID string) (*Conn, error) {
 	}
 }
 
+// GetSession picks one of the sessions serving the subdomain
 func (cp *ConnectionPooler) GetSession(subdomain string) (*Session, error) {
-	if hasSub := cp.HasSubdomain(subdomain); !hasSub {
+	cp.SessMu.Lock()
+	defer cp.SessMu.Unlock()
+
+	session := pickSession(cp.SubdomainToSession[subdomain], cp.SubdomainNext, subdomain)
+	if session == nil {
 		return nil, SubdomainNotFoundError
 	}
 
+	return session, nil
+}
+
+// GetSessionByHostname picks one of the sessions serving the custom domain
+func (cp *ConnectionPooler) GetSessionByHostname(hostname string) (*Session, error) {
 	cp.SessMu.Lock()
 	defer cp.SessMu.Unlock()
-	return cp.SubdomainToSession[subdomain], nil
+
+	session := pickSession(cp.HostnameToSession[hostname], cp.HostnameNext, hostname)
+	if session == nil {
+		return nil, HostnameNotFoundError
+	}
+
+	return session, nil
+}
+
+// pickSession load balances between the members of a group, a lone session
+// is always picked. Detached members are passed over while another member is
+// still attached, nil is returned when the group is gone
+func pickSession(sessions []*Session, next map[string]uint64, key string) *Session {
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	if len(sessions) == 1 {
+		return sessions[0]
+	}
+
+	attached := []*Session{}
+	for _, session := range sessions {
+		if !session.IsDetached() {
+			attached = append(attached, session)
+		}
+	}
+
+	if len(attached) > 0 {
+		sessions = attached
+	}
+
+	if MainConfig.LoadBalancing == LeastConnLoadBalancing {
+		picked := sessions[0]
+		for _, session := range sessions[1:] {
+			if session.ActiveConns.Load() < picked.ActiveConns.Load() {
+				picked = session
+			}
+		}
+
+		return picked
+	}
+
+	picked := sessions[next[key]%uint64(len(sessions))]
+	next[key]++
+	return picked
+}
+
+// canJoinGroup reports whether a new session may share a subdomain or
+// hostname with the sessions already on it
+func canJoinGroup(sessions []*Session, token string, group bool) bool {
+	if !group {
+		return false
+	}
+
+	for _, session := range sessions {
+		if !session.Group || session.Token != token {
+			return false
+		}
+	}
+
+	return true
+}
+
+func removeFromGroup(sessions []*Session, session *Session) []*Session {
+	remaining := []*Session{}
+	for _, member := range sessions {
+		if member != session {
+			remaining = append(remaining, member)
+		}
+	}
+
+	return remaining
 }
 
 func (cp *ConnectionPooler) PutConn(sessionID string, c *Conn) error {
-	if !cp.IsSessionInPool(sessionID) {
+	cp.SessMu.Lock()
+	sess, ok := cp.Sessions[sessionID]
+	cp.SessMu.Unlock()
+
+	if !ok {
 		return SessionNotFoundError
 	}
 
-	sess := cp.Sessions[sessionID]
 	sess.ConnMu.Lock()
 	defer sess.ConnMu.Unlock()
 
+	// a connection dialed before the tunnel dropped or the session ended
+	// would never be taken nor released
+	select {
+	case <-sess.done:
+		return SessionNotFoundError
+	default:
+	}
+
+	if sess.TunnelConn == nil {
+		return TunnelOfflineError
+	}
+
+	// the requested connection arrived, whether it fits or not
+	if sess.Pending > 0 {
+		sess.Pending--
+	}
+
+	if int(sess.ActiveConns.Load())+len(sess.Connections) >= sess.MaxConns {
+		return PoolFullError
+	}
+
 	select {
 	case sess.Connections <- c:
 	default:
@@ -118,8 +365,16 @@ func (cp *ConnectionPooler) StartPrunner() {
 	}
 }
 
+// Prune lets go of pool connections idle for longer than IdleTimeout
 func (cp *ConnectionPooler) Prune() {
+	cp.SessMu.Lock()
+	sessions := make([]*Session, 0, len(cp.Sessions))
 	for _, sess := range cp.Sessions {
+		sessions = append(sessions, sess)
+	}
+	cp.SessMu.Unlock()
+
+	for _, sess := range sessions {
 		sess.ConnMu.Lock()
 		connLength := len(sess.Connections)
 
@@ -131,49 +386,105 @@ func (cp *ConnectionPooler) Prune() {
 				sess.Connections <- curr
 			} else {
 				(*curr.Conn).Close()
+				close(curr.Done)
 			}
 		}
 
 		sess.ConnMu.Unlock()
-		newConnLength := len(sess.Connections)
-		nextOpen := GetNextOpen(newConnLength)
-		sess.NextOpen = nextOpen
 	}
 }
 
-func (cp *ConnectionPooler) AddSession(sessionID, subdomain string, tunnel *net.Conn) (*Session, error) {
+func (cp *ConnectionPooler) AddSession(sessionID, subdomain, hostname, token string, options *SessionOptions, tunnel *net.Conn) (*Session, error) {
 	cp.SessMu.Lock()
 	defer cp.SessMu.Unlock()
 
-	if _, alreadyIn := cp.SubdomainToSession[subdomain]; alreadyIn {
-		return nil, SubdomainAlreadyExistsError
+	if _, alreadyIn := cp.Sessions[sessionID]; alreadyIn {
+		return nil, SessionAlreadyExistsError
+	}
+
+	if members, alreadyIn := cp.SubdomainToSession[subdomain]; alreadyIn && subdomain != "" {
+		if !canJoinGroup(members, token, options.Group) {
+			return nil, SubdomainAlreadyExistsError
+		}
+	}
+
+	if members, alreadyIn := cp.HostnameToSession[hostname]; alreadyIn && hostname != "" {
+		if !canJoinGroup(members, token, options.Group) {
+			return nil, HostnameAlreadyExistsError
+		}
 	}
 
 	newSession := &Session{
-		SessionID:  sessionID,
-		Subdomain:  subdomain,
-		TunnelConn: tunnel, NextOpen: 5,
-		Connections: make(chan *Conn, MAX_CHAN_SIZE),
+		SessionID:   sessionID,
+		Subdomain:   subdomain,
+		Hostname:    hostname,
+		Token:       token,
+		Protocol:    options.Protocol,
+		ForwardAddr: options.ForwardAddr,
+		Http2:       options.Http2,
+		Group:       options.Group,
+		IpRules:     options.IpRules,
+		TunnelConn:  tunnel,
+		MaxConns:    options.MaxConns,
+		Connections: make(chan *Conn, options.MaxConns),
+		slots:       make(chan struct{}, options.MaxConns),
+		done:        make(chan struct{}),
+		ResumeToken: options.ResumeToken,
+		resumes:     make(chan *tunnelAttachment),
+	}
+
+	if subdomain != "" {
+		cp.SubdomainToSession[subdomain] = append(cp.SubdomainToSession[subdomain], newSession)
+	}
+
+	if hostname != "" {
+		cp.HostnameToSession[hostname] = append(cp.HostnameToSession[hostname], newSession)
 	}
 
-	cp.SubdomainToSession[subdomain] = newSession
 	cp.Sessions[sessionID] = newSession
 	return newSession, nil
 }
 
+// RemoveSession ends a session, its idle pool connections are let go
 func (cp *ConnectionPooler) RemoveSession(sessionID string) error {
-	if !cp.IsSessionInPool(sessionID) {
-		return SessionNotFoundError
-	}
-
 	cp.SessMu.Lock()
 	defer cp.SessMu.Unlock()
 
-	session := cp.Sessions[sessionID]
-	subdomain := (*session).Subdomain
+	session, ok := cp.Sessions[sessionID]
+	if !ok {
+		return SessionNotFoundError
+	}
+
+	subdomain := session.Subdomain
 
 	delete(cp.Sessions, sessionID)
-	delete(cp.SubdomainToSession, subdomain)
+	close(session.done)
+
+	// PutConn refuses connections once done is closed, so none are added
+	// after the drain
+	session.ConnMu.Lock()
+	for len(session.Connections) > 0 {
+		close((<-session.Connections).Done)
+	}
+	session.ConnMu.Unlock()
+
+	// the other members of a group keep serving
+	if subdomain != "" {
+		cp.SubdomainToSession[subdomain] = removeFromGroup(cp.SubdomainToSession[subdomain], session)
+		if len(cp.SubdomainToSession[subdomain]) == 0 {
+			delete(cp.SubdomainToSession, subdomain)
+			delete(cp.SubdomainNext, subdomain)
+		}
+	}
+
+	if session.Hostname != "" {
+		cp.HostnameToSession[session.Hostname] = removeFromGroup(cp.HostnameToSession[session.Hostname], session)
+		if len(cp.HostnameToSession[session.Hostname]) == 0 {
+			delete(cp.HostnameToSession, session.Hostname)
+			delete(cp.HostnameNext, session.Hostname)
+		}
+	}
+
 	return nil
 }
 
@@ -185,28 +496,45 @@ func (cp *ConnectionPooler) HasSubdomain(subdomain string) bool {
 	return cp.IsSubdomainInPool(subdomain)
 }
 
-func (cp *ConnectionPooler) OpenMoreConns(session *Session) error {
-	tunnelConn := (*session.TunnelConn)
-	err := WriteUint32(tunnelConn, uint32(session.NextOpen))
-	session.NextOpen = GetNextOpen(session.NextOpen)
-	return err
+func (s *Session) addConnWaiter(delta int) {
+	s.ConnMu.Lock()
+	defer s.ConnMu.Unlock()
+	s.connWaiters += delta
 }
 
-func GetNextOpen(length int) int {
-	newLimit := 5
-	for start := 5; start != 0; start *= 2 {
-		if start > length {
-			newLimit = start
-			break
-		}
+// OpenMoreConns asks the client for the pool connections still missing for
+// the waiting public connections once the idle and requested ones are
+// counted, the pool never grows past the session's MaxConns. Nothing is
+// asked of a detached session
+func (cp *ConnectionPooler) OpenMoreConns(session *Session) error {
+	session.ConnMu.Lock()
+	defer session.ConnMu.Unlock()
+
+	if session.Pending > 0 && time.Now().After(session.PendingExpiry) {
+		session.Pending = 0
+	}
+
+	shortfall := session.connWaiters - len(session.Connections) - session.Pending
+	room := session.MaxConns - int(session.ActiveConns.Load()) - len(session.Connections) - session.Pending
+	count := min(shortfall, room)
+	if count <= 0 || session.TunnelConn == nil {
+		return nil
 	}
-	return newLimit
+
+	tunnelConn := (*session.TunnelConn)
+	err := WriteUint32(tunnelConn, uint32(count))
+	session.Pending += count
+	session.PendingExpiry = time.Now().Add(ConnRequestTimeout)
+	return err
 }
 
 func NewConnectionPooler() *ConnectionPooler {
 	return &ConnectionPooler{
 		Sessions:           map[string]*Session{},
-		SubdomainToSession: map[string]*Session{},
+		SubdomainToSession: map[string][]*Session{},
+		HostnameToSession:  map[string][]*Session{},
+		SubdomainNext:      map[string]uint64{},
+		HostnameNext:       map[string]uint64{},
 		IdleTimeout:        1 * time.Minute,
 	}
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickSessionEmptyGroup(t *testing.T) {
+	for _, mode := range []LoadBalancing{RoundRobinLoadBalancing, LeastConnLoadBalancing} {
+		MainConfig.LoadBalancing = mode
+		if session := pickSession(nil, map[string]uint64{}, "gone"); session != nil {
+			t.Errorf("%s: pickSession of an empty group = %v", mode, session)
+		}
+	}
+
+	MainConfig.LoadBalancing = RoundRobinLoadBalancing
+}
+
+func TestGetSessionAfterRemove(t *testing.T) {
+	pooler := NewConnectionPooler()
+	options := &SessionOptions{Protocol: "http", MaxConns: 1}
+
+	_, err := pooler.AddSession("session", "demo", "demo.example.com", "token", options, nil)
+	if err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+
+	pooler.RemoveSession("session")
+
+	if _, err := pooler.GetSession("demo"); err != SubdomainNotFoundError {
+		t.Errorf("GetSession = %v, want %v", err, SubdomainNotFoundError)
+	}
+
+	if _, err := pooler.GetSessionByHostname("demo.example.com"); err != HostnameNotFoundError {
+		t.Errorf("GetSessionByHostname = %v, want %v", err, HostnameNotFoundError)
+	}
+}
+
+func TestPutConnAfterDetachOrRemove(t *testing.T) {
+	tunnel, other := net.Pipe()
+	defer tunnel.Close()
+	defer other.Close()
+
+	pooler := NewConnectionPooler()
+	options := &SessionOptions{Protocol: "http", MaxConns: 4}
+	session, err := pooler.AddSession("session", "demo", "", "token", options, &tunnel)
+	if err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+
+	queued := &Conn{SessionID: "session", Done: make(chan struct{})}
+	if err := pooler.PutConn("session", queued); err != nil {
+		t.Fatalf("PutConn: %v", err)
+	}
+
+	session.detach()
+	if err := pooler.PutConn("session", &Conn{Done: make(chan struct{})}); err != TunnelOfflineError {
+		t.Errorf("PutConn on a detached session = %v, want %v", err, TunnelOfflineError)
+	}
+
+	select {
+	case <-queued.Done:
+	default:
+		t.Error("detach left a queued connection waiting")
+	}
+
+	session.attach(&tunnel)
+	queued = &Conn{SessionID: "session", Done: make(chan struct{})}
+	if err := pooler.PutConn("session", queued); err != nil {
+		t.Fatalf("PutConn after attach: %v", err)
+	}
+
+	pooler.RemoveSession("session")
+	select {
+	case <-queued.Done:
+	default:
+		t.Error("RemoveSession left a queued connection waiting")
+	}
+
+	// PutConn may have looked the session up just before it was removed
+	pooler.Sessions["session"] = session
+	if err := pooler.PutConn("session", &Conn{Done: make(chan struct{})}); err != SessionNotFoundError {
+		t.Errorf("PutConn on a removed session = %v, want %v", err, SessionNotFoundError)
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samuelships/harlot/utils"
+	"golang.org/x/net/http2"
+)
+
+type ErrorPageFormat string
+
+const (
+	// HtmlErrorPageFormat serves html unless the request asks for json
+	HtmlErrorPageFormat ErrorPageFormat = "html"
+	JsonErrorPageFormat ErrorPageFormat = "json"
+
+	ErrorPageReadTimeoutSecs = 10
+)
+
+var (
+	TunnelOfflineError   = errors.New("Tunnel offline")
+	UpstreamTimeoutError = errors.New("Upstream timed out")
+)
+
+// ErrorPage is served in place of a tunnel that cannot take the request
+type ErrorPage struct {
+	StatusCode int
+	Code       string
+	Title      string
+	Message    string
+}
+
+var (
+	TunnelNotFoundPage = &ErrorPage{
+		StatusCode: http.StatusNotFound,
+		Code:       "tunnel_not_found",
+		Title:      "Tunnel not found",
+		Message:    "There is no tunnel running on this host.",
+	}
+
+	TunnelOfflinePage = &ErrorPage{
+		StatusCode: http.StatusBadGateway,
+		Code:       "tunnel_offline",
+		Title:      "Tunnel offline",
+		Message:    "The client behind this tunnel is not reachable right now.",
+	}
+
+	IpNotAllowedPage = &ErrorPage{
+		StatusCode: http.StatusForbidden,
+		Code:       "ip_not_allowed",
+		Title:      "Access denied",
+		Message:    "Your address is not allowed to reach this tunnel.",
+	}
+
+	QuotaExceededPage = &ErrorPage{
+		StatusCode: http.StatusForbidden,
+		Code:       "quota_exceeded",
+		Title:      "Quota exceeded",
+		Message:    "This tunnel used up its monthly transfer quota.",
+	}
+
+	TunnelBusyPage = &ErrorPage{
+		StatusCode: http.StatusServiceUnavailable,
+		Code:       "tunnel_busy",
+		Title:      "Tunnel busy",
+		Message:    "This tunnel is serving as many connections as it can, try again shortly.",
+	}
+
+	TooManyRequestsPage = &ErrorPage{
+		StatusCode: http.StatusTooManyRequests,
+		Code:       "rate_limited",
+		Title:      "Too many requests",
+		Message:    "This tunnel is receiving too many requests, try again shortly.",
+	}
+
+	UpstreamTimeoutPage = &ErrorPage{
+		StatusCode: http.StatusGatewayTimeout,
+		Code:       "upstream_timed_out",
+		Title:      "Upstream timed out",
+		Message:    "The client behind this tunnel did not pick up the request in time.",
+	}
+)
+
+const defaultErrorPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.StatusCode}} {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 4em auto; color: #333; }
+code { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p><code>{{.Host}} &middot; {{.Code}}</code></p>
+</body>
+</html>
+`
+
+// MainErrorPageTemplate renders html error pages, it can be replaced with
+// LoadErrorPageTemplate
+var MainErrorPageTemplate = template.Must(template.New("error").Parse(defaultErrorPageTemplate))
+
+// LoadErrorPageTemplate replaces the html error page with a template file,
+// it is given the StatusCode, Code, Title, Message and Host of the error
+func LoadErrorPageTemplate(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New("error").Parse(string(content))
+	if err != nil {
+		return err
+	}
+
+	MainErrorPageTemplate = tmpl
+	return nil
+}
+
+// ErrorPageFor returns the page matching an error from proxyToSession
+func ErrorPageFor(err error) *ErrorPage {
+	if errors.Is(err, UpstreamTimeoutError) {
+		return UpstreamTimeoutPage
+	}
+
+	if errors.Is(err, IpNotAllowedError) {
+		return IpNotAllowedPage
+	}
+
+	if errors.Is(err, RateLimitedError) {
+		return TooManyRequestsPage
+	}
+
+	if errors.Is(err, QuotaExceededError) {
+		return QuotaExceededPage
+	}
+
+	if errors.Is(err, TunnelBusyError) {
+		return TunnelBusyPage
+	}
+
+	return TunnelOfflinePage
+}
+
+type errorPageData struct {
+	*ErrorPage
+	Host string
+}
+
+// ErrorPageHandler answers every request with the page
+func ErrorPageHandler(page *ErrorPage, host string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := &errorPageData{ErrorPage: page, Host: host}
+		w.Header().Set("Cache-Control", "no-store")
+
+		if wantsJsonErrorPage(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(page.StatusCode)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  page.StatusCode,
+				"error":   page.Code,
+				"message": page.Message,
+				"host":    host,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(page.StatusCode)
+		err := MainErrorPageTemplate.Execute(w, data)
+		if err != nil {
+			utils.LogError("Error rendering error page : %v", err)
+		}
+	})
+}
+
+func wantsJsonErrorPage(r *http.Request) bool {
+	if MainConfig.ErrorPageFormat == JsonErrorPageFormat {
+		return true
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// ServeErrorPage answers the next request on a plaintext connection with
+// the page, h2 is spoken when it was negotiated during the tls handshake
+func ServeErrorPage(conn net.Conn, reader *bufio.Reader, page *ErrorPage, host string) {
+	conn.SetDeadline(time.Now().Add(ErrorPageReadTimeoutSecs * time.Second))
+	handler := ErrorPageHandler(page, host)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		(&http2.Server{}).ServeConn(tlsConn, &http2.ServeConnOpts{Handler: handler})
+		return
+	}
+
+	err := ServeHttpRequest(conn, reader, handler)
+	if err != nil {
+		utils.LogInfo("Could not serve error page", err)
+	}
+}
+
+// ServeTlsErrorPage finishes the tls handshake of a passthrough connection
+// with the server's own certificate and serves the page
+func ServeTlsErrorPage(conn net.Conn, reader *bufio.Reader, page *ErrorPage, host string) {
+	if MainConfig.PublicTlsConfig == nil {
+		return
+	}
+
+	tlsConfig := MainConfig.PublicTlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	tlsConn := tls.Server(&peekedConn{Conn: conn, reader: reader}, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(ErrorPageReadTimeoutSecs * time.Second))
+	err := tlsConn.Handshake()
+	if err != nil {
+		utils.LogInfo("Tls handshake for error page failed", err)
+		return
+	}
+
+	ServeErrorPage(tlsConn, bufio.NewReader(tlsConn), page, host)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/samuelships/harlot/utils"
+)
+
+const (
+	// ProtocolVersion is the control protocol spoken by this build, it is
+	// bumped whenever a message changes shape
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest protocol still understood
+	MinProtocolVersion = 1
+)
+
+// Version of harlot, set at build time with
+// -ldflags "-X github.com/samuelships/harlot/server.Version=..."
+var Version = "dev"
+
+var (
+	MissingHelloError         = errors.New("Connection did not start with hello")
+	IncompatibleProtocolError = errors.New("Incompatible protocol version")
+	UnsupportedFeatureError   = errors.New("Feature was not agreed on in hello")
+)
+
+// Capability is a feature bit, both sides offer theirs in the hello exchange
+// and only the features offered by both are used
+type Capability uint32
+
+const (
+	// ForwardAddrCapability sends public peer addresses in stream headers
+	// for the proxy protocol and forwarded headers
+	ForwardAddrCapability Capability = 1 << iota
+	// UdpCapability allows udp tunnels
+	UdpCapability
+	// ResumeCapability holds dropped tunnels for their client
+	ResumeCapability
+)
+
+// SupportedCapabilities are the features this build implements
+const SupportedCapabilities = ForwardAddrCapability | UdpCapability | ResumeCapability
+
+func (c Capability) Has(capability Capability) bool {
+	return c&capability == capability
+}
+
+// HelloRequest is the first thing a client sends on every connection
+type HelloRequest struct {
+	ProtocolVersion uint32
+	ClientVersion   string
+	Capabilities    Capability
+}
+
+func WriteHelloRequest(writer io.Writer, req *HelloRequest) error {
+	err := WriteUint32(writer, req.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, req.ClientVersion)
+	if err != nil {
+		return err
+	}
+
+	return WriteUint32(writer, uint32(req.Capabilities))
+}
+
+func ReadHelloRequest(reader io.Reader) (*HelloRequest, error) {
+	protocolVersion, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	clientVersion, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HelloRequest{
+		ProtocolVersion: protocolVersion,
+		ClientVersion:   clientVersion,
+		Capabilities:    Capability(capabilities),
+	}, nil
+}
+
+// HelloResponse carries the protocol version both sides speak from now on
+// and the capabilities they agreed on, Error says why a client was refused
+type HelloResponse struct {
+	Success         bool
+	ProtocolVersion uint32
+	ServerVersion   string
+	Capabilities    Capability
+	Error           string
+}
+
+func WriteHelloResponse(writer io.Writer, resp *HelloResponse) error {
+	err := WriteBool(writer, resp.Success)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, resp.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, resp.ServerVersion)
+	if err != nil {
+		return err
+	}
+
+	err = WriteUint32(writer, uint32(resp.Capabilities))
+	if err != nil {
+		return err
+	}
+
+	return WriteString(writer, resp.Error)
+}
+
+func ReadHelloResponse(reader io.Reader) (*HelloResponse, error) {
+	success, err := ReadBool(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	protocolVersion, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serverVersion, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HelloResponse{
+		Success:         success,
+		ProtocolVersion: protocolVersion,
+		ServerVersion:   serverVersion,
+		Capabilities:    Capability(capabilities),
+		Error:           message,
+	}, nil
+}
+
+// IsSupportedProtocol reports whether this build speaks a protocol version
+func IsSupportedProtocol(version uint32) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// HandleHelloAction expects the hello at the start of a connection and
+// answers with the agreed capabilities, clients speaking an unknown protocol
+// version are told which ones the server speaks
+func HandleHelloAction(conn *net.Conn) (Capability, error) {
+	action, err := ReadUint32(*conn)
+	if err != nil {
+		return 0, err
+	}
+
+	// clients from before the hello exchange start with another action
+	if Action(action) != Hello {
+		return 0, MissingHelloError
+	}
+
+	req, err := ReadHelloRequest(*conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if !IsSupportedProtocol(req.ProtocolVersion) {
+		utils.LogInfo("Refused client speaking an unsupported protocol",
+			slog.Uint64("protocol", uint64(req.ProtocolVersion)),
+			slog.String("clientVersion", req.ClientVersion),
+		)
+
+		message := fmt.Sprintf("Client %s speaks protocol version %d but server %s speaks %d to %d, upgrade the older side",
+			req.ClientVersion, req.ProtocolVersion, Version, MinProtocolVersion, ProtocolVersion)
+		err = WriteHelloResponse(*conn, &HelloResponse{
+			Success:         false,
+			ProtocolVersion: ProtocolVersion,
+			ServerVersion:   Version,
+			Error:           message,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		return 0, IncompatibleProtocolError
+	}
+
+	capabilities := req.Capabilities & SupportedCapabilities
+	err = WriteHelloResponse(*conn, &HelloResponse{
+		Success:         true,
+		ProtocolVersion: req.ProtocolVersion,
+		ServerVersion:   Version,
+		Capabilities:    capabilities,
+	})
+
+	return capabilities, err
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/samuelships/harlot/utils"
+)
+
+func TestHelloRequestRoundTrip(t *testing.T) {
+	want := &HelloRequest{ProtocolVersion: ProtocolVersion, ClientVersion: "v1.2.3", Capabilities: SupportedCapabilities}
+
+	var buffer bytes.Buffer
+	if err := WriteHelloRequest(&buffer, want); err != nil {
+		t.Fatalf("WriteHelloRequest: %v", err)
+	}
+
+	encoded := buffer.Bytes()
+	req, err := ReadHelloRequest(bytes.NewReader(encoded))
+	if err != nil || !reflect.DeepEqual(req, want) {
+		t.Errorf("ReadHelloRequest = %+v, %v, want %+v", req, err, want)
+	}
+
+	assertTruncationFails(t, encoded, func(r io.Reader) error {
+		_, err := ReadHelloRequest(r)
+		return err
+	})
+}
+
+func TestHelloResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *HelloResponse
+	}{
+		{"accepted", &HelloResponse{Success: true, ProtocolVersion: 1, ServerVersion: "v1.2.3", Capabilities: ForwardAddrCapability | ResumeCapability}},
+		{"refused", &HelloResponse{ProtocolVersion: 1, ServerVersion: "dev", Error: "Client v0.1 speaks protocol version 9"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteHelloResponse(&buffer, tc.resp); err != nil {
+				t.Fatalf("WriteHelloResponse: %v", err)
+			}
+
+			encoded := buffer.Bytes()
+			resp, err := ReadHelloResponse(bytes.NewReader(encoded))
+			if err != nil || !reflect.DeepEqual(resp, tc.resp) {
+				t.Errorf("ReadHelloResponse = %+v, %v, want %+v", resp, err, tc.resp)
+			}
+
+			assertTruncationFails(t, encoded, func(r io.Reader) error {
+				_, err := ReadHelloResponse(r)
+				return err
+			})
+		})
+	}
+}
+
+// bufferConn is a connection that reads what a client sent and keeps what
+// was written back
+type bufferConn struct {
+	net.Conn
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func TestHandleHelloAction(t *testing.T) {
+	utils.Logger = utils.NewTestLogger()
+
+	tests := []struct {
+		name         string
+		req          *HelloRequest
+		success      bool
+		capabilities Capability
+		err          error
+	}{
+		{"agrees on shared capabilities", &HelloRequest{ProtocolVersion: ProtocolVersion, ClientVersion: "v1", Capabilities: UdpCapability | 1<<20}, true, UdpCapability, nil},
+		{"unsupported protocol", &HelloRequest{ProtocolVersion: ProtocolVersion + 1, ClientVersion: "v9"}, false, 0, IncompatibleProtocolError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent bytes.Buffer
+			WriteUint32(&sent, uint32(Hello))
+			WriteHelloRequest(&sent, tc.req)
+
+			buffer := &bufferConn{in: bytes.NewReader(sent.Bytes())}
+			var conn net.Conn = buffer
+			capabilities, err := HandleHelloAction(&conn)
+			if capabilities != tc.capabilities || err != tc.err {
+				t.Errorf("HandleHelloAction = %v, %v, want %v, %v", capabilities, err, tc.capabilities, tc.err)
+			}
+
+			resp, err := ReadHelloResponse(&buffer.out)
+			if err != nil {
+				t.Fatalf("ReadHelloResponse: %v", err)
+			}
+
+			if resp.Success != tc.success || resp.Capabilities != tc.capabilities || resp.ServerVersion != Version {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+
+	// clients from before the hello exchange start with another action
+	var sent bytes.Buffer
+	WriteUint32(&sent, uint32(Tunnel))
+	var conn net.Conn = &bufferConn{in: bytes.NewReader(sent.Bytes())}
+	if _, err := HandleHelloAction(&conn); err != MissingHelloError {
+		t.Errorf("HandleHelloAction without hello = %v, want %v", err, MissingHelloError)
+	}
+}
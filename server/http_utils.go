@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// bufferedResponseWriter collects a handler's response so it can be written
+// to a raw connection
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+// ServeHttpRequest reads a single request from the connection, runs it
+// through the handler and writes back the response before closing
+func ServeHttpRequest(conn net.Conn, reader *bufio.Reader, handler http.Handler) error {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+
+	req.RemoteAddr = conn.RemoteAddr().String()
+	return WriteHandlerResponse(conn, req, handler)
+}
+
+// WriteHandlerResponse runs an already read request through the handler and
+// writes the response, asking the peer to close
+func WriteHandlerResponse(writer io.Writer, req *http.Request, handler http.Handler) error {
+	bufferedWriter := &bufferedResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(bufferedWriter, req)
+
+	if bufferedWriter.statusCode == 0 {
+		bufferedWriter.statusCode = http.StatusOK
+	}
+
+	resp := &http.Response{
+		StatusCode:    bufferedWriter.statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        bufferedWriter.header,
+		Body:          io.NopCloser(&bufferedWriter.body),
+		ContentLength: int64(bufferedWriter.body.Len()),
+		Close:         true,
+		Request:       req,
+	}
+
+	return resp.Write(writer)
+}
+
+// WriteHttpStatus writes a plain text response and asks the peer to close
+func WriteHttpStatus(writer io.Writer, statusCode int, body string) error {
+	resp := &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+
+	return resp.Write(writer)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+var (
+	IpNotAllowedError = errors.New("Ip not allowed")
+)
+
+// IpRules restricts which public addresses may reach a tunnel, a deny match
+// always wins and an empty allow list lets every other address in
+type IpRules struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+func ParseIpRules(allow, deny []string) (*IpRules, error) {
+	allowPrefixes, err := ParsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyPrefixes, err := ParsePrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IpRules{Allow: allowPrefixes, Deny: denyPrefixes}, nil
+}
+
+// ParsePrefixes parses cidrs, a bare ip is taken as a single address
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q", value)
+			}
+
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", value)
+		}
+
+		// peers are matched unmapped, so ::ffff:10.0.0.0/104 becomes 10.0.0.0/8
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func (r *IpRules) IsEmpty() bool {
+	return r == nil || (len(r.Allow) == 0 && len(r.Deny) == 0)
+}
+
+// Allows reports whether a public peer may use the tunnel
+func (r *IpRules) Allows(addr net.Addr) bool {
+	if r.IsEmpty() {
+		return true
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := addrPort.Addr().Unmap()
+	if containsAddr(r.Deny, ip) {
+		return false
+	}
+
+	return len(r.Allow) == 0 || containsAddr(r.Allow, ip)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package server
+
+import "testing"
+
+// peerAddr is a net.Addr that keeps the exact text of an address, a
+// net.TCPAddr would print ipv4 mapped addresses in ipv4 form
+type peerAddr string
+
+func (a peerAddr) Network() string { return "tcp" }
+func (a peerAddr) String() string  { return string(a) }
+
+func TestIpRulesAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		peer  string
+		want  bool
+	}{
+		{"no rules", nil, nil, "203.0.113.7:40000", true},
+		{"ipv4 allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3:40000", true},
+		{"ipv4 not allowed", []string{"10.0.0.0/8"}, nil, "192.0.2.1:40000", false},
+		{"mapped peer allowed by ipv4 cidr", []string{"10.0.0.0/8"}, nil, "[::ffff:10.1.2.3]:40000", true},
+		{"mapped peer outside ipv4 cidr", []string{"10.0.0.0/8"}, nil, "[::ffff:192.0.2.1]:40000", false},
+		{"mapped peer denied by ipv4 address", nil, []string{"192.0.2.1"}, "[::ffff:192.0.2.1]:40000", false},
+		{"mapped peer denied by ipv4 cidr", nil, []string{"192.0.2.0/24"}, "[::ffff:192.0.2.99]:40000", false},
+		{"ipv4 peer allowed by mapped address", []string{"::ffff:10.1.2.3"}, nil, "10.1.2.3:40000", true},
+		{"ipv4 peer allowed by mapped cidr", []string{"::ffff:10.0.0.0/104"}, nil, "10.9.9.9:40000", true},
+		{"ipv4 peer outside mapped cidr", []string{"::ffff:10.0.0.0/104"}, nil, "11.0.0.1:40000", false},
+		{"mapped peer denied by mapped cidr", nil, []string{"::ffff:192.0.2.0/120"}, "[::ffff:192.0.2.5]:40000", false},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "[::ffff:10.0.0.5]:40000", false},
+		{"ipv6 allowed", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:40000", true},
+		{"ipv6 cidr does not cover ipv4", []string{"::/0"}, nil, "10.0.0.1:40000", false},
+		{"ipv4 cidr does not cover ipv6", []string{"0.0.0.0/0"}, nil, "[2001:db8::1]:40000", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := ParseIpRules(tc.allow, tc.deny)
+			if err != nil {
+				t.Fatalf("ParseIpRules: %v", err)
+			}
+
+			if allowed := rules.Allows(peerAddr(tc.peer)); allowed != tc.want {
+				t.Errorf("Allows(%s) = %v, want %v", tc.peer, allowed, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefixesRejects(t *testing.T) {
+	for _, value := range []string{"", "10.0.0.0/33", "not-an-ip", "10.0.0.1/", "2001:db8::/129"} {
+		if _, err := ParsePrefixes([]string{value}); err == nil {
+			t.Errorf("ParsePrefixes(%q): no error", value)
+		}
+	}
+}
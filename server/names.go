@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// RandomSubdomainAttempts is how often a taken name is drawn again
+	RandomSubdomainAttempts = 10
+)
+
+var subdomainAdjectives = []string{
+	"amber", "ancient", "autumn", "bold", "brave", "bright", "calm", "clever",
+	"cool", "cosmic", "crimson", "curious", "daring", "dusty", "eager", "fancy",
+	"fuzzy", "gentle", "golden", "happy", "hidden", "humble", "icy", "jolly",
+	"lively", "lucky", "mellow", "misty", "nimble", "noble", "proud", "quick",
+	"quiet", "rapid", "rusty", "shiny", "silent", "silver", "sleepy", "snowy",
+	"solar", "steady", "sunny", "swift", "tidy", "wild", "witty", "zesty",
+}
+
+var subdomainAnimals = []string{
+	"badger", "bat", "bear", "beaver", "bison", "crane", "crow", "deer",
+	"dingo", "dolphin", "eagle", "falcon", "ferret", "finch", "fox", "gecko",
+	"heron", "ibis", "jackal", "koala", "lemur", "lion", "llama", "lynx",
+	"marmot", "moose", "newt", "otter", "owl", "panda", "parrot", "puffin",
+	"quail", "rabbit", "raven", "robin", "salmon", "seal", "shark", "sloth",
+	"swan", "tiger", "toad", "turtle", "walrus", "whale", "wolf", "yak",
+}
+
+// RandomSubdomain draws a readable name such as brave-otter-42
+func RandomSubdomain() string {
+	return fmt.Sprintf("%s-%s-%d",
+		subdomainAdjectives[rand.Intn(len(subdomainAdjectives))],
+		subdomainAnimals[rand.Intn(len(subdomainAnimals))],
+		rand.Intn(90)+10,
+	)
+}
+
+// pickRandomSubdomain draws names until one is neither in use, reserved nor
+// blocked
+func pickRandomSubdomain() string {
+	name := RandomSubdomain()
+	for attempt := 1; attempt < RandomSubdomainAttempts && !isSubdomainFree(name); attempt++ {
+		name = RandomSubdomain()
+	}
+
+	return name
+}
+
+func isSubdomainFree(name string) bool {
+	return !MainConfig.IsBlockedSubdomain(name) && !MainConnectionPooler.HasSubdomain(name) && MainTokenStore.CanUseSubdomain(name, "")
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	DefaultTcpPortRangeStart = 10000
+	DefaultTcpPortRangeEnd   = 10999
+)
+
+var (
+	NoFreePortError = errors.New("No free port in range")
+)
+
+var MainPortAllocator = NewPortAllocator(DefaultTcpPortRangeStart, DefaultTcpPortRangeEnd)
+
+// PortAllocator hands out public ports for tcp and udp tunnels from an
+// inclusive range
+type PortAllocator struct {
+	Start int
+	End   int
+	InUse map[int]bool
+	Mu    sync.Mutex
+}
+
+func (pa *PortAllocator) Allocate() (int, error) {
+	pa.Mu.Lock()
+	defer pa.Mu.Unlock()
+
+	for port := pa.Start; port <= pa.End; port++ {
+		if !pa.InUse[port] {
+			pa.InUse[port] = true
+			return port, nil
+		}
+	}
+
+	return 0, NoFreePortError
+}
+
+func (pa *PortAllocator) Release(port int) {
+	pa.Mu.Lock()
+	defer pa.Mu.Unlock()
+	delete(pa.InUse, port)
+}
+
+// Listen reserves a port and starts a plain server on it, ports that are
+// taken by something outside harlot are skipped
+func (pa *PortAllocator) Listen(handler func(*net.Conn)) (*Server, int, error) {
+	skipped := []int{}
+	defer func() {
+		for _, port := range skipped {
+			pa.Release(port)
+		}
+	}()
+
+	for {
+		port, err := pa.Allocate()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		server, err := CreatePlainServer(port, handler)
+		if err != nil {
+			skipped = append(skipped, port)
+			continue
+		}
+
+		return server, port, nil
+	}
+}
+
+// ListenUdp reserves a port and binds a udp socket on it
+func (pa *PortAllocator) ListenUdp() (*net.UDPConn, int, error) {
+	skipped := []int{}
+	defer func() {
+		for _, port := range skipped {
+			pa.Release(port)
+		}
+	}()
+
+	for {
+		port, err := pa.Allocate()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			skipped = append(skipped, port)
+			continue
+		}
+
+		return udpConn, port, nil
+	}
+}
+
+func NewPortAllocator(start, end int) *PortAllocator {
+	return &PortAllocator{
+		Start: start,
+		End:   end,
+		InUse: map[int]bool{},
+	}
+}
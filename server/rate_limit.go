@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/samuelships/harlot/utils"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// RateLimiterIdleTimeout is how long an unused bucket is kept, a full
+	// bucket behaves the same as a new one
+	RateLimiterIdleTimeout = 5 * time.Minute
+)
+
+var (
+	RateLimitedError = errors.New("Rate limited")
+)
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps a token bucket per key, a zero rate disables it
+type RateLimiter struct {
+	Rate     rate.Limit
+	Burst    int
+	Limiters map[string]*rateLimiterEntry
+	Mu       sync.Mutex
+}
+
+func (rl *RateLimiter) Enabled() bool {
+	return rl.Rate > 0
+}
+
+func (rl *RateLimiter) Allow(key string) bool {
+	if !rl.Enabled() {
+		return true
+	}
+
+	rl.Mu.Lock()
+	defer rl.Mu.Unlock()
+
+	entry, ok := rl.Limiters[key]
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(rl.Rate, rl.Burst)}
+		rl.Limiters[key] = entry
+	}
+
+	entry.lastSeen = time.Now()
+	return entry.limiter.Allow()
+}
+
+func (rl *RateLimiter) Prune() {
+	rl.Mu.Lock()
+	defer rl.Mu.Unlock()
+
+	for key, entry := range rl.Limiters {
+		if time.Since(entry.lastSeen) > RateLimiterIdleTimeout {
+			delete(rl.Limiters, key)
+		}
+	}
+}
+
+// NewRateLimiter allows perSecond events with a burst of one second's worth
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	return &RateLimiter{
+		Rate:     rate.Limit(perSecond),
+		Burst:    int(math.Max(1, math.Ceil(perSecond))),
+		Limiters: map[string]*rateLimiterEntry{},
+	}
+}
+
+// RateLimits are checked for every new public connection and, on plaintext
+// http streams, for every request
+type RateLimits struct {
+	PerIp     *RateLimiter
+	PerTunnel *RateLimiter
+	PerToken  *RateLimiter
+}
+
+var MainRateLimits = NewRateLimits(0, 0, 0)
+
+func NewRateLimits(perIp, perTunnel, perToken float64) *RateLimits {
+	return &RateLimits{
+		PerIp:     NewRateLimiter(perIp),
+		PerTunnel: NewRateLimiter(perTunnel),
+		PerToken:  NewRateLimiter(perToken),
+	}
+}
+
+func (rl *RateLimits) Enabled() bool {
+	return rl.PerIp.Enabled() || rl.PerTunnel.Enabled() || rl.PerToken.Enabled()
+}
+
+// Allow takes a token from every bucket the peer falls under, the peer's ip
+// is limited per tunnel
+func (rl *RateLimits) Allow(session *Session, remoteAddr net.Addr) error {
+	ip := remoteAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	limit := ""
+	switch {
+	case !rl.PerIp.Allow(session.SessionID + "|" + ip):
+		limit = "ip"
+	case !rl.PerTunnel.Allow(session.SessionID):
+		limit = "tunnel"
+	case !rl.PerToken.Allow(session.Token):
+		limit = "token"
+	default:
+		return nil
+	}
+
+	utils.LogInfo("Rate limited",
+		slog.String("limit", limit),
+		slog.String("remote", remoteAddr.String()),
+		slog.String("subdomain", session.Subdomain),
+	)
+
+	return RateLimitedError
+}
+
+func (rl *RateLimits) StartPrunner() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		rl.PerIp.Prune()
+		rl.PerTunnel.Prune()
+		rl.PerToken.Prune()
+	}
+}
+
+// copyLimitedHttpRequests forwards the requests of a plaintext http stream
+// one by one so each of them is rate limited. Clients only send the next
+// request once the previous response arrived, so a rejected request is
+// returned with nothing left in flight. Upgraded connections are copied raw
+func copyLimitedHttpRequests(dst io.Writer, src io.Reader, session *Session, remoteAddr net.Addr) (*http.Request, error) {
+	reader := bufio.NewReader(src)
+	for first := true; ; first = false {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		// the first request was already counted with the connection
+		if !first {
+			if err := MainRateLimits.Allow(session, remoteAddr); err != nil {
+				return req, err
+			}
+		}
+
+		// keep req.Write from adding its own user agent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = nil
+		}
+
+		err = req.Write(dst)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Header.Get("Upgrade") != "" {
+			_, err = io.Copy(dst, reader)
+			return nil, err
+		}
+	}
+}
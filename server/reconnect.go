@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/samuelships/harlot/utils"
+)
+
+const (
+	// ResumeHandoffTimeout is how long a resumed tunnel waits for the
+	// handler owning the session to take it
+	ResumeHandoffTimeout = 5 * time.Second
+)
+
+var (
+	ResumeRefusedError = errors.New("Session cannot be resumed")
+)
+
+// tunnelAttachment is a tunnel connection a client came back with, done is
+// closed once it drops again
+type tunnelAttachment struct {
+	conn *net.Conn
+	done chan struct{}
+}
+
+// IsDetached reports whether the session lost its tunnel connection and is
+// waiting for the client to come back
+func (s *Session) IsDetached() bool {
+	s.ConnMu.Lock()
+	defer s.ConnMu.Unlock()
+	return s.TunnelConn == nil
+}
+
+// detach forgets the dropped tunnel connection, the idle pool connections
+// went down with it
+func (s *Session) detach() {
+	s.ConnMu.Lock()
+	defer s.ConnMu.Unlock()
+
+	s.TunnelConn = nil
+	s.Pending = 0
+	for len(s.Connections) > 0 {
+		close((<-s.Connections).Done)
+	}
+}
+
+func (s *Session) attach(conn *net.Conn) {
+	s.ConnMu.Lock()
+	defer s.ConnMu.Unlock()
+
+	s.TunnelConn = conn
+	s.Pending = 0
+}
+
+// closeTunnel drops the current tunnel connection, one that still looks
+// alive may be half open after the client changed networks
+func (s *Session) closeTunnel() {
+	s.ConnMu.Lock()
+	defer s.ConnMu.Unlock()
+
+	if s.TunnelConn != nil {
+		(*s.TunnelConn).Close()
+	}
+}
+
+// awaitResume keeps the detached session for the grace period, it returns
+// true once a resumed tunnel connection dropped again and false when the
+// client did not come back in time
+func (s *Session) awaitResume(grace time.Duration) bool {
+	s.detach()
+	if grace <= 0 {
+		return false
+	}
+
+	utils.LogInfo("Tunnel detached, holding it for its client",
+		slog.String("subdomain", s.Subdomain),
+		slog.Duration("grace", grace),
+	)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case attachment := <-s.resumes:
+		<-attachment.done
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// ResumeSession reattaches a client to its session, SessionNotFoundError
+// means the grace period is over and the tunnel has to be set up again
+func (cp *ConnectionPooler) ResumeSession(req *TunnelRequest, conn *net.Conn) (*Session, *tunnelAttachment, error) {
+	cp.SessMu.Lock()
+	session, ok := cp.Sessions[req.SessionID]
+	cp.SessMu.Unlock()
+
+	if !ok {
+		return nil, nil, SessionNotFoundError
+	}
+
+	if session.Token != req.Token || subtle.ConstantTimeCompare([]byte(session.ResumeToken), []byte(req.ResumeToken)) != 1 {
+		return nil, nil, ResumeRefusedError
+	}
+
+	session.closeTunnel()
+
+	attachment := &tunnelAttachment{conn: conn, done: make(chan struct{})}
+	select {
+	case session.resumes <- attachment:
+		return session, attachment, nil
+	case <-session.done:
+		return nil, nil, SessionNotFoundError
+	case <-time.After(ResumeHandoffTimeout):
+		return nil, nil, ResumeRefusedError
+	}
+}
@@ -3,13 +3,16 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
-	"strings"
-	"time"
+	"net/http"
 
 	"github.com/samuelships/harlot/utils"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
 )
 
 var MainConnectionPooler = NewConnectionPooler()
@@ -17,7 +20,6 @@ var MainTokenStore = NewTokenStore()
 
 const (
 	ConnectionGetWaitTimeoutSecs = 5
-	ConnectionGetRetry           = 1
 )
 
 type Server struct {
@@ -43,6 +45,14 @@ func (s *Server) Start() {
 
 func PrivateServerHandler(conn *net.Conn) {
 	defer (*conn).Close()
+
+	// every connection starts with the hello exchange
+	capabilities, err := HandleHelloAction(conn)
+	if err != nil {
+		utils.LogInfo("Hello failed", slog.String("err", err.Error()))
+		return
+	}
+
 	for {
 		var action Action
 		actionUint, err := ReadUint32(*conn)
@@ -60,11 +70,17 @@ func PrivateServerHandler(conn *net.Conn) {
 			HandleLoginAction(conn)
 			return
 		case Tunnel:
-			HandleTunnelServer(conn)
+			HandleTunnelServer(conn, capabilities)
 			return
 		case JoinPool:
 			HandleJoinPool(conn)
 			return
+		case Reserve:
+			HandleReserveAction(conn)
+			return
+		case Release:
+			HandleReleaseAction(conn)
+			return
 		default:
 			utils.LogError("invalid action")
 			return
@@ -75,77 +91,243 @@ func PrivateServerHandler(conn *net.Conn) {
 func PublicServerHandler(conn *net.Conn) {
 	defer (*conn).Close()
 
-	peakConn := bufio.NewReader((*conn))
+	peakConn := bufio.NewReaderSize((*conn), MaxClientHelloBytes)
 	sniName, err := ReadSNIFromClientHello(peakConn)
 	if err != nil {
-		utils.LogInfo("Could not read sni name from tls connection")
+		utils.LogInfo("Could not read sni name from tls connection", slog.String("err", err.Error()))
 		return
 	}
 
-	sniNameSplit := strings.Split(sniName, ".")
-	if len(sniNameSplit) < 1 {
-		utils.LogInfo("We need atleast 1 parts")
+	// the server's own hosts are only terminated here to answer tls-alpn-01
+	if MainCertManager != nil && MainConfig.IsAcmeHost(sniName) {
+		tlsConn := tls.Server(&peekedConn{Conn: *conn, reader: peakConn}, MainCertManager.TLSConfig())
+		tlsConn.Handshake()
 		return
 	}
 
-	subdomain := sniNameSplit[0]
-	if hasSubdomain := MainConnectionPooler.HasSubdomain(subdomain); !hasSubdomain {
-		utils.LogInfo("Subdomain does not exist")
+	session, err := getSessionForHost(sniName)
+	if errors.Is(err, ForeignHostError) {
+		utils.LogInfo("Rejected foreign sni name", slog.String("sni", sniName))
+		WriteTlsAlert(*conn, TlsAlertUnrecognizedName)
 		return
 	}
 
-	session, err := MainConnectionPooler.GetSession(subdomain)
 	if err != nil {
-		utils.LogError("Subdomain does not exist : %w", err)
+		utils.LogInfo("Subdomain does not exist", slog.String("sni", sniName))
+		ServeTlsErrorPage(*conn, peakConn, TunnelNotFoundPage, sniName)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(),
-		time.Second*ConnectionGetWaitTimeoutSecs,
-	)
+	if MainConfig.TlsMode == EdgeTlsMode {
+		tlsConn := tls.Server(&peekedConn{Conn: *conn, reader: peakConn}, MainConfig.EdgeTlsConfig(session.Http2))
+		err = tlsConn.Handshake()
+		if err != nil {
+			utils.LogInfo("Tls handshake failed", err)
+			return
+		}
 
-	defer cancel()
+		if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+			return
+		}
 
-	var poolConn *Conn
-	var calledOpened = false
-retry:
-	select {
-	case <-ctx.Done():
-		utils.LogError("Error getting connection to proxy to : %w", err)
-		return
-	default:
-		poolConn, err = MainConnectionPooler.GetConn(session.SessionID)
+		var terminatedConn net.Conn = tlsConn
+		err = proxyToSession(&terminatedConn, tlsConn, session, TerminatedTlsStream)
 		if err != nil {
-			if !errors.Is(err, PoolEmptyError) {
-				utils.LogError("Error getting connection to proxy to : %v \n", err)
-				return
-			}
+			ServeErrorPage(tlsConn, bufio.NewReader(tlsConn), ErrorPageFor(err), sniName)
+		}
 
-			if !calledOpened {
-				MainConnectionPooler.OpenMoreConns(session)
-				calledOpened = true
-			}
+		return
+	}
 
-			time.Sleep(ConnectionGetRetry * time.Millisecond)
-			goto retry
-		}
+	err = proxyToSession(conn, peakConn, session, TlsStream)
+	if err != nil {
+		ServeTlsErrorPage(*conn, peakConn, ErrorPageFor(err), sniName)
+	}
+}
+
+// HttpServerHandler serves plain http traffic, the request is routed with
+// the host header and streamed to the client untouched
+func HttpServerHandler(conn *net.Conn) {
+	defer (*conn).Close()
+
+	peakConn := bufio.NewReaderSize((*conn), MaxHttpHeaderBytes)
+	req, err := PeekHttpRequest(peakConn)
+	if err != nil {
+		utils.LogInfo("Could not read http request")
+		return
+	}
+
+	if IsAcmeChallengeRequest(req) {
+		ServeHttpRequest(*conn, peakConn, MainCertManager.HTTPHandler(nil))
+		return
+	}
+
+	host, err := ReadHostFromHttpRequest(req)
+	if err != nil {
+		utils.LogInfo("Could not read host from http request")
+		return
+	}
+
+	session, err := getSessionForHost(host)
+	if errors.Is(err, ForeignHostError) {
+		utils.LogInfo("Rejected foreign host", slog.String("host", host))
+		WriteHttpStatus(*conn, http.StatusMisdirectedRequest, "Host is not served here")
+		return
+	}
+
+	if err != nil {
+		utils.LogInfo("Subdomain does not exist", slog.String("host", host))
+		ServeErrorPage(*conn, peakConn, TunnelNotFoundPage, host)
+		return
+	}
+
+	err = proxyToSession(conn, peakConn, session, HttpStream)
+	if err != nil {
+		ServeErrorPage(*conn, peakConn, ErrorPageFor(err), host)
+	}
+}
+
+// TcpServerHandler serves a public connection on a tcp tunnel's own port,
+// nothing is parsed since the session is known from the port
+func TcpServerHandler(conn *net.Conn, session *Session) {
+	defer (*conn).Close()
+	proxyToSession(conn, *conn, session, TcpStream)
+}
+
+// getSessionForHost routes a public hostname to its session, custom domains
+// are matched on the full hostname and everything else by subdomain
+func getSessionForHost(host string) (*Session, error) {
+	host = NormalizeHostname(host)
+	if session, err := MainConnectionPooler.GetSessionByHostname(host); err == nil {
+		return session, nil
+	}
+
+	subdomain, ok := MainConfig.SubdomainOf(host)
+	if !ok {
+		return nil, ForeignHostError
+	}
+
+	return MainConnectionPooler.GetSession(subdomain)
+}
+
+// acquirePoolConn queues for one of the session's connection slots and
+// then waits for a pooled connection. It fails with TunnelBusyError when the
+// queue is full, TunnelOfflineError when the client cannot be reached and
+// UpstreamTimeoutError when nothing frees up in time
+func acquirePoolConn(session *Session) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MainConfig.ConnQueueTimeout)
+	defer cancel()
+
+	err := session.AcquireSlot(ctx)
+	if err != nil {
+		utils.LogInfo("No connection slot for tunnel", slog.String("subdomain", session.Subdomain), slog.String("err", err.Error()))
+		return nil, err
+	}
+
+	poolConn, err := MainConnectionPooler.WaitConn(ctx, session)
+	if err != nil {
+		session.ReleaseSlot()
+		utils.LogError("Error getting connection to proxy to : %v", err)
+		return nil, err
+	}
+
+	session.ActiveConns.Add(1)
+	return poolConn, nil
+}
+
+// releasePoolConn gives back the slot taken by acquirePoolConn and lets the
+// pool connection go
+func releasePoolConn(session *Session, poolConn *Conn) {
+	session.ActiveConns.Add(-1)
+	session.ReleaseSlot()
+	poolConn.Done <- struct{}{}
+}
+
+// proxyToSession takes a connection from the session's pool, tells the
+// client what kind of stream is coming and then copies bytes both ways. An
+// error is only returned when nothing was read from the public connection
+func proxyToSession(conn *net.Conn, reader io.Reader, session *Session, kind StreamKind) error {
+	remoteAddr := (*conn).RemoteAddr()
+	if !session.IpRules.Allows(remoteAddr) {
+		utils.LogInfo("Rejected connection by ip rules", slog.String("remote", remoteAddr.String()))
+		return IpNotAllowedError
+	}
+
+	err := MainRateLimits.Allow(session, remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	if token := MainTokenStore.GetToken(session.Token); token != nil && token.IsOverQuota() {
+		utils.LogInfo("Rejected connection over quota", slog.String("subdomain", session.Subdomain))
+		return QuotaExceededError
+	}
+
+	poolConn, err := acquirePoolConn(session)
+	if err != nil {
+		return err
+	}
+
+	defer releasePoolConn(session, poolConn)
+
+	header := &StreamHeader{Kind: kind}
+	if session.ForwardAddr {
+		header.RemoteAddr = (*conn).RemoteAddr().String()
+		header.LocalAddr = (*conn).LocalAddr().String()
 	}
 
+	err = WriteStreamHeader(*poolConn.Conn, header)
+	if err != nil {
+		utils.LogError("Error writing stream header : %v", err)
+		(*poolConn.Conn).Close()
+		return TunnelOfflineError
+	}
+
+	upstream := newMeteredWriter(*poolConn.Conn, session, Upstream)
+	downstream := newMeteredWriter(*conn, session, Downstream)
+
+	rateLimited := make(chan *http.Request, 1)
 	go func() {
-		_, err := io.Copy((*poolConn.Conn), peakConn)
-		if err != nil {
-			// utils.LogDebug("error copying into session conn")
+		if isLimitedHttpStream(*conn, session, kind) {
+			req, err := copyLimitedHttpRequests(upstream, reader, session, remoteAddr)
+			if errors.Is(err, RateLimitedError) {
+				rateLimited <- req
+			}
+		} else {
+			_, err := io.Copy(upstream, reader)
+			if err != nil {
+				// utils.LogDebug("error copying into session conn")
+			}
 		}
 
 		(*poolConn.Conn).Close()
 		// utils.LogDebug(fmt.Sprintf("copied %d into session conn\n", n))
 	}()
 
-	_, err = io.Copy((*conn), (*poolConn.Conn))
+	_, err = io.Copy(downstream, (*poolConn.Conn))
 	if err != nil {
 		// utils.LogError("error copying into conn")
 	}
 
-	(*poolConn).Done <- struct{}{}
+	select {
+	case req := <-rateLimited:
+		WriteHandlerResponse(*conn, req, ErrorPageHandler(TooManyRequestsPage, req.Host))
+	default:
+	}
+
+	return nil
+}
+
+// isLimitedHttpStream reports whether requests are rate limited one by one,
+// which needs plaintext HTTP/1.x reaching an http tunnel
+func isLimitedHttpStream(conn net.Conn, session *Session, kind StreamKind) bool {
+	if !MainRateLimits.Enabled() || !IsHttpProtocol(session.Protocol) {
+		return false
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return kind == TerminatedTlsStream && tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS
+	}
+
+	return kind == HttpStream
 }
@@ -2,12 +2,16 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 )
 
@@ -19,35 +23,245 @@ const (
 	Login
 	Tunnel
 	JoinPool
+	Reserve
+	Release
+	Hello
 )
 
+// StreamKind tells the client what the server is about to send down a pool
+// connection once it has been matched with a public connection
+type StreamKind uint32
+
+const (
+	// TlsStream carries the public tls connection untouched
+	TlsStream StreamKind = iota
+	// HttpStream carries plain http from the public http listener
+	HttpStream
+	// TcpStream carries raw bytes from a tcp tunnel's public port
+	TcpStream
+	// TerminatedTlsStream carries plaintext from a tls connection the
+	// server has already terminated
+	TerminatedTlsStream
+	// UdpStream carries framed datagrams of a single udp peer
+	UdpStream
+)
+
+const (
+	MaxHttpHeaderBytes = 16 * 1024
+	MaxDatagramSize    = 65535
+)
+
+// StreamHeader is written down a pool connection before any public bytes,
+// the addresses are only filled in when the tunnel asked for them
+type StreamHeader struct {
+	Kind       StreamKind
+	RemoteAddr string
+	LocalAddr  string
+}
+
+func WriteStreamHeader(writer io.Writer, header *StreamHeader) error {
+	err := WriteUint32(writer, uint32(header.Kind))
+	if err != nil {
+		return err
+	}
+
+	err = WriteString(writer, header.RemoteAddr)
+	if err != nil {
+		return err
+	}
+
+	return WriteString(writer, header.LocalAddr)
+}
+
+func ReadStreamHeader(reader io.Reader) (*StreamHeader, error) {
+	kind, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAddr, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	localAddr, err := ReadString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamHeader{
+		Kind:       StreamKind(kind),
+		RemoteAddr: remoteAddr,
+		LocalAddr:  localAddr,
+	}, nil
+}
+
+var (
+	ForeignHostError          = errors.New("Host is not under the base domain")
+	InvalidHostnameError      = errors.New("Hostname is invalid")
+	HostnameClaimedError      = errors.New("Hostname is claimed by another token")
+	InvalidTokenError         = errors.New("Token is invalid")
+	SubdomainReservedError    = errors.New("Subdomain is reserved by another token")
+	SubdomainNotReservedError = errors.New("Subdomain is not reserved by this token")
+)
+
+// TokenInfo is what the server keeps about a registered token
+type TokenInfo struct {
+	// MonthlyQuota caps the bytes moved in a calendar month, it overrides
+	// the server default when set
+	MonthlyQuota int64
+	Usage        TokenUsage
+}
+
+func NewTokenInfo() *TokenInfo {
+	return &TokenInfo{}
+}
+
+func (t *TokenInfo) Quota() int64 {
+	if t.MonthlyQuota > 0 {
+		return t.MonthlyQuota
+	}
+
+	return MainConfig.MonthlyQuota
+}
+
+func (t *TokenInfo) IsOverQuota() bool {
+	quota := t.Quota()
+	return quota > 0 && t.Usage.Total() >= quota
+}
+
 type TokenStore struct {
-	Tokens map[string]interface{}
-	Mu     sync.Mutex
+	Tokens map[string]*TokenInfo
+	// Hostnames maps custom domains to the token serving them
+	Hostnames map[string]*hostnameClaim
+	// Subdomains maps reserved subdomains to the token owning them
+	Subdomains map[string]string
+	Mu         sync.Mutex
 }
 
-func (t *TokenStore) AddToken(key string, value interface{}) {
+func (t *TokenStore) AddToken(key string, value *TokenInfo) {
 	t.Mu.Lock()
 	defer t.Mu.Unlock()
 	t.Tokens[key] = value
 }
 
-func (t *TokenStore) GetToken(key string) interface{} {
+func (t *TokenStore) GetToken(key string) *TokenInfo {
 	t.Mu.Lock()
 	defer t.Mu.Unlock()
 	return t.Tokens[key]
 }
 
+// SetMonthlyQuota gives a token its own monthly transfer quota in bytes, 0
+// falls back to the server default
+func (t *TokenStore) SetMonthlyQuota(key string, quota int64) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	token, ok := t.Tokens[key]
+	if !ok {
+		return InvalidTokenError
+	}
+
+	token.MonthlyQuota = quota
+	return nil
+}
+
+// hostnameClaim counts the sessions a token serves a custom domain with
+type hostnameClaim struct {
+	token    string
+	sessions int
+}
+
+// ClaimHostname binds a custom domain to a token for one more session, the
+// token keeps the hostname until all of them released it
+func (t *TokenStore) ClaimHostname(hostname, token string) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	claim, ok := t.Hostnames[hostname]
+	if !ok {
+		claim = &hostnameClaim{token: token}
+		t.Hostnames[hostname] = claim
+	}
+
+	if claim.token != token {
+		return HostnameClaimedError
+	}
+
+	claim.sessions++
+	return nil
+}
+
+// ReleaseHostname gives up the claim of one session, the hostname is free
+// for other tokens once the last one is gone
+func (t *TokenStore) ReleaseHostname(hostname, token string) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	claim, ok := t.Hostnames[hostname]
+	if !ok || claim.token != token {
+		return
+	}
+
+	claim.sessions--
+	if claim.sessions <= 0 {
+		delete(t.Hostnames, hostname)
+	}
+}
+
+// ReserveSubdomain keeps a subdomain for a token until it is released
+func (t *TokenStore) ReserveSubdomain(subdomain, token string) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	if owner, ok := t.Subdomains[subdomain]; ok && owner != token {
+		return SubdomainReservedError
+	}
+
+	t.Subdomains[subdomain] = token
+	return nil
+}
+
+func (t *TokenStore) ReleaseSubdomain(subdomain, token string) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	if owner, ok := t.Subdomains[subdomain]; !ok || owner != token {
+		return SubdomainNotReservedError
+	}
+
+	delete(t.Subdomains, subdomain)
+	return nil
+}
+
+// CanUseSubdomain reports whether the subdomain is free of reservations by
+// other tokens
+func (t *TokenStore) CanUseSubdomain(subdomain, token string) bool {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	owner, ok := t.Subdomains[subdomain]
+	return !ok || owner == token
+}
+
 func NewTokenStore() *TokenStore {
 	// TODO : remove fixed value
 	// TODO : persist tokens to db
-	return &TokenStore{Tokens: map[string]interface{}{
-		"LN97ccrfGrZX4rtiATmdDKImbQnbMW8BYWBWVrnfQpw=": "--",
-	}}
+	return &TokenStore{
+		Tokens: map[string]*TokenInfo{
+			"LN97ccrfGrZX4rtiATmdDKImbQnbMW8BYWBWVrnfQpw=": NewTokenInfo(),
+		},
+		Hostnames:  map[string]*hostnameClaim{},
+		Subdomains: map[string]string{},
+	}
 }
 
 func GetServerTlsConfig() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair("serverCert.pem", "serverKey.pem")
+	if MainCertManager != nil {
+		return MainCertManager.TLSConfig(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(MainConfig.CertFile, MainConfig.KeyFile)
 	if err != nil {
 		return nil, err
 	}
@@ -96,106 +310,116 @@ func GenerateToken(length uint) (string, error) {
 	return base64.URLEncoding.EncodeToString(tokenBytes), nil
 }
 
-func ReadSNIFromClientHello(peakReader *bufio.Reader) (string, error) {
-	header, err := peakReader.Peek(9)
-	if err != nil {
-		return "", err
-	}
-
-	if len(header) < 9 {
-		return "", errors.New("Data must be atleast 9 bytes")
-	}
-
-	if header[0] != 0x16 {
-		return "", errors.New("Not a tls record header")
-	}
-
-	if header[1] != 0x03 || header[2] != 0x01 {
-		return "", errors.New("Not tls 1.0")
-	}
-
-	recordLength := int(header[3])<<8 | int(header[4])
-	fullRecord, err := peakReader.Peek(5 + recordLength)
-	if err != nil {
-		return "", err
-	}
-
-	if recordLength+5 != len(fullRecord) {
-		return "", errors.New("Failed to fetch entire client hello")
-	}
+// peekedConn is a net.Conn whose reads go through a reader that has
+// already peeked at the start of the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
 
-	// handshake header
-	fullRecord = fullRecord[5:]
-	if fullRecord[0] != 0x01 {
-		return "", errors.New("Not client hello")
-	}
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
 
-	// delete handshake + length
-	fullRecord = fullRecord[4:]
+const (
+	TlsAlertUnrecognizedName = 112
+)
 
-	// delete client version
-	fullRecord = fullRecord[2:]
+// WriteTlsAlert sends a fatal tls alert record, it is used to refuse a
+// connection before any handshake has happened
+func WriteTlsAlert(writer io.Writer, description byte) error {
+	// content type alert, tls 1.0, length 2, level fatal
+	record := []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, description}
+	return WriteBuffer(writer, record)
+}
 
-	// delete client random
-	fullRecord = fullRecord[32:]
+// NormalizeHostname lowercases a hostname and drops a trailing dot
+func NormalizeHostname(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	return strings.TrimSuffix(hostname, ".")
+}
 
-	sessionIDLength := int(fullRecord[0])
+func IsHttpProtocol(protocol string) bool {
+	return protocol == "http" || protocol == "https"
+}
 
-	// delete session id length
-	fullRecord = fullRecord[1:]
+func IsTcpProtocol(protocol string) bool {
+	return protocol == "tcp" || protocol == "tcps"
+}
 
-	// delete session id
-	fullRecord = fullRecord[sessionIDLength:]
+func IsUdpProtocol(protocol string) bool {
+	return protocol == "udp"
+}
 
-	cipherSuiteLength := int(fullRecord[0])<<8 | int(fullRecord[1])
+// HasOwnPort reports whether a tunnel protocol gets its own public port
+func HasOwnPort(protocol string) bool {
+	return IsTcpProtocol(protocol) || IsUdpProtocol(protocol)
+}
 
-	// delete cipher suite length
-	fullRecord = fullRecord[2:]
+// WriteDatagram frames a single udp datagram on a stream
+func WriteDatagram(writer io.Writer, datagram []byte) error {
+	err := WriteUint32(writer, uint32(len(datagram)))
+	if err != nil {
+		return err
+	}
 
-	// delete cipher suite
-	fullRecord = fullRecord[cipherSuiteLength:]
+	return WriteBuffer(writer, datagram)
+}
 
-	cmLength := int(fullRecord[0])
+func ReadDatagram(reader io.Reader) ([]byte, error) {
+	length, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
 
-	// delete compression methods length
-	fullRecord = fullRecord[1:]
+	if length > MaxDatagramSize {
+		return nil, errors.New("Datagram too large")
+	}
 
-	// delete cm
-	fullRecord = fullRecord[cmLength:]
+	return ReadIntoBuffer(reader, length)
+}
 
-	// delete extension length
-	fullRecord = fullRecord[2:]
-	serverName := ""
+// PeekHttpRequest peeks at the request line and headers of an HTTP/1.x
+// request without consuming anything, the body is not available
+func PeekHttpRequest(peakReader *bufio.Reader) (*http.Request, error) {
+	headerEnd := []byte("\r\n\r\n")
+	peekSize := 1
 
 	for {
-		extensionData := int(fullRecord[0])<<8 | int(fullRecord[1])
-		extensionLength := int(fullRecord[2])<<8 | int(fullRecord[3])
+		data, err := peakReader.Peek(peekSize)
+		if err != nil {
+			return nil, err
+		}
 
-		if extensionData == 0 {
-			// delete ex data and ex length
-			fullRecord = fullRecord[4:]
+		data, _ = peakReader.Peek(peakReader.Buffered())
+		if bytes.Contains(data, headerEnd) {
+			break
+		}
 
-			// delete all except extension
-			fullRecord = fullRecord[:extensionLength]
+		if len(data) >= peakReader.Size() {
+			return nil, errors.New("Http headers too large")
+		}
 
-			for {
-				currLength := int(fullRecord[0])<<8 | int(fullRecord[1])
-				if fullRecord[2] == 0x00 {
-					// hostnameLength := int(fullRecord[3])<<8 | int(fullRecord[4])
-					serverName = string(fullRecord[5:])
-				}
+		peekSize = len(data) + 1
+	}
 
-				fullRecord = fullRecord[2+currLength:]
-				break
-			}
+	data, _ := peakReader.Peek(peakReader.Buffered())
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+}
 
-			break
-		}
+// ReadHostFromHttpRequest returns the lowercased host of a peeked request
+// without its port
+func ReadHostFromHttpRequest(req *http.Request) (string, error) {
+	host := req.Host
+	if host == "" {
+		return "", errors.New("Missing host header")
+	}
 
-		fullRecord = fullRecord[4+extensionLength:]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
 	}
 
-	return serverName, nil
+	return strings.ToLower(host), nil
 }
 
 func PrintHex(data []byte) {
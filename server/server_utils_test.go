@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/samuelships/harlot/utils"
+)
+
+// openTunnel runs a tunnel request for the token through HandleTunnelServer,
+// the connection drops right after the response
+func openTunnel(t *testing.T, token string) *TunnelResponse {
+	t.Helper()
+
+	var sent bytes.Buffer
+	WriteTunnelRequest(&sent, &TunnelRequest{Token: token, SessionID: token + "-session", Protocol: "http"})
+
+	buffer := &bufferConn{in: bytes.NewReader(sent.Bytes())}
+	var conn net.Conn = buffer
+	HandleTunnelServer(&conn, 0)
+
+	resp, err := ReadTunnelResponse(&buffer.out)
+	if err != nil {
+		t.Fatalf("ReadTunnelResponse: %v", err)
+	}
+
+	return resp
+}
+
+func TestTokenMonthlyQuota(t *testing.T) {
+	utils.Logger = utils.NewTestLogger()
+
+	defaultQuota := MainConfig.MonthlyQuota
+	MainConfig.MonthlyQuota = 1 << 30
+	MainTokenStore.AddToken("limited", NewTokenInfo())
+	MainTokenStore.AddToken("default", NewTokenInfo())
+	t.Cleanup(func() {
+		MainConfig.MonthlyQuota = defaultQuota
+		MainTokenStore.Mu.Lock()
+		delete(MainTokenStore.Tokens, "limited")
+		delete(MainTokenStore.Tokens, "default")
+		MainTokenStore.Mu.Unlock()
+	})
+
+	if err := MainTokenStore.SetMonthlyQuota("limited", 100); err != nil {
+		t.Fatalf("SetMonthlyQuota: %v", err)
+	}
+
+	if err := MainTokenStore.SetMonthlyQuota("unknown", 100); err != InvalidTokenError {
+		t.Errorf("SetMonthlyQuota of an unknown token = %v, want %v", err, InvalidTokenError)
+	}
+
+	for _, token := range []string{"limited", "default"} {
+		MainTokenStore.GetToken(token).Usage.Add(Upstream, 150)
+	}
+
+	if !MainTokenStore.GetToken("limited").IsOverQuota() {
+		t.Error("token over its own quota is not over quota")
+	}
+
+	if MainTokenStore.GetToken("default").IsOverQuota() {
+		t.Error("token under the server quota is over quota")
+	}
+
+	if resp := openTunnel(t, "limited"); resp.Success || resp.ErrorCode != QuotaExceededCode {
+		t.Errorf("tunnel of the limited token = %+v, want %v", resp, QuotaExceededCode)
+	}
+
+	if resp := openTunnel(t, "default"); !resp.Success {
+		t.Errorf("tunnel of the default token refused: %+v", resp)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	// MaxSubdomainLength is the longest dns label
+	MaxSubdomainLength = 63
+	// MaxHostnameLength is the longest dns name
+	MaxHostnameLength = 253
+)
+
+var (
+	InvalidSubdomainError = errors.New("Subdomain must be 1 to 63 letters, digits or hyphens and cannot start or end with a hyphen")
+	BlockedSubdomainError = errors.New("Subdomain is not available")
+)
+
+// DefaultBlockedSubdomains are names of common services that would mislead
+// visitors, only the whole subdomain is matched against them
+var DefaultBlockedSubdomains = []string{
+	"admin", "api", "app", "auth", "blog", "cdn", "dashboard", "dns", "docs",
+	"ftp", "help", "imap", "login", "mail", "ns1", "ns2", "pop", "root",
+	"smtp", "static", "status", "support", "webmail", "www",
+}
+
+// DefaultBlockedWords are words nobody should be served on, they are matched
+// against each hyphen separated word of a subdomain
+var DefaultBlockedWords = []string{
+	"asshole", "bitch", "cunt", "dick", "fuck", "porn", "shit", "slut", "whore",
+}
+
+// ValidateSubdomain normalizes a requested subdomain and checks that it is a
+// single dns label that is not blocked
+func ValidateSubdomain(subdomain string) (string, error) {
+	subdomain = NormalizeHostname(subdomain)
+	if !isDnsLabel(subdomain) {
+		return "", InvalidSubdomainError
+	}
+
+	if MainConfig.IsBlockedSubdomain(subdomain) {
+		return "", BlockedSubdomainError
+	}
+
+	return subdomain, nil
+}
+
+func isDnsLabel(label string) bool {
+	if len(label) == 0 || len(label) > MaxSubdomainLength {
+		return false
+	}
+
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsBlockedSubdomain matches the whole subdomain against the blocked
+// subdomains and each of its hyphen separated words against the blocked
+// words, so my-app stays free while a blocked word cannot be dodged with a
+// suffix
+func (c *Config) IsBlockedSubdomain(subdomain string) bool {
+	if slices.Contains(c.BlockedSubdomains, subdomain) {
+		return true
+	}
+
+	for _, word := range strings.Split(subdomain, "-") {
+		if slices.Contains(c.BlockedWords, word) {
+			return true
+		}
+	}
+
+	return false
+}
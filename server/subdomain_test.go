@@ -0,0 +1,31 @@
+package server
+
+import "testing"
+
+func TestIsBlockedSubdomain(t *testing.T) {
+	config := NewConfig()
+
+	tests := []struct {
+		subdomain string
+		blocked   bool
+	}{
+		{"www", true},
+		{"api", true},
+		{"status", true},
+		{"shit", true},
+		{"shit-happens", true},
+		{"my-porn-site", true},
+		{"my-app", false},
+		{"payments-api", false},
+		{"status-page", false},
+		{"help-center", false},
+		{"shitake", false},
+		{"brave-otter-42", false},
+	}
+
+	for _, tc := range tests {
+		if blocked := config.IsBlockedSubdomain(tc.subdomain); blocked != tc.blocked {
+			t.Errorf("IsBlockedSubdomain(%q) = %v, want %v", tc.subdomain, blocked, tc.blocked)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/samuelships/harlot/utils"
+)
+
+const (
+	UdpFlowQueueSize = 64
+	// MinUdpIdleTimeout is the shortest idle timeout, flows are pruned
+	// every half of it
+	MinUdpIdleTimeout = 1 * time.Second
+)
+
+// udpFlow is the traffic of a single public peer, it gets its own pool
+// connection so the client can keep one local socket per peer
+type udpFlow struct {
+	peer       *net.UDPAddr
+	packets    chan []byte
+	lastActive time.Time
+	mu         sync.Mutex
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastActive = time.Now()
+}
+
+func (f *udpFlow) idleFor() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.lastActive)
+}
+
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+// UdpRelay reads datagrams from a tunnel's public udp port and hands them to
+// per peer flows
+type UdpRelay struct {
+	Conn    *net.UDPConn
+	Session *Session
+	Flows   map[string]*udpFlow
+	Mu      sync.Mutex
+}
+
+func (r *UdpRelay) Start() {
+	go func() {
+		r.pruneIdleFlows()
+	}()
+
+	defer r.closeAllFlows()
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, peer, err := r.Conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		if !r.Session.IpRules.Allows(peer) {
+			continue
+		}
+
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+
+		flow := r.getOrCreateFlow(peer)
+		if flow == nil {
+			continue
+		}
+
+		flow.touch()
+
+		select {
+		case flow.packets <- datagram:
+		default:
+			// the flow is still waiting for a pool connection, drop like
+			// a full socket buffer would
+		}
+	}
+}
+
+// getOrCreateFlow returns the peer's flow, nil when a new flow is rate limited
+func (r *UdpRelay) getOrCreateFlow(peer *net.UDPAddr) *udpFlow {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	key := peer.String()
+	if flow, ok := r.Flows[key]; ok {
+		return flow
+	}
+
+	// a new peer counts as a new connection
+	if MainRateLimits.Allow(r.Session, peer) != nil {
+		return nil
+	}
+
+	flow := &udpFlow{
+		peer:       peer,
+		packets:    make(chan []byte, UdpFlowQueueSize),
+		lastActive: time.Now(),
+		done:       make(chan struct{}),
+	}
+
+	r.Flows[key] = flow
+	go func() {
+		r.serveFlow(flow)
+		r.removeFlow(key, flow)
+	}()
+
+	return flow
+}
+
+func (r *UdpRelay) removeFlow(key string, flow *udpFlow) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if r.Flows[key] == flow {
+		delete(r.Flows, key)
+	}
+}
+
+// serveFlow moves datagrams between the public peer and a pool connection
+// until either side goes away or the flow expires
+func (r *UdpRelay) serveFlow(flow *udpFlow) {
+	defer flow.close()
+
+	poolConn, err := acquirePoolConn(r.Session)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		(*poolConn.Conn).Close()
+		releasePoolConn(r.Session, poolConn)
+	}()
+
+	header := &StreamHeader{Kind: UdpStream}
+	if r.Session.ForwardAddr {
+		header.RemoteAddr = flow.peer.String()
+		header.LocalAddr = r.Conn.LocalAddr().String()
+	}
+
+	err = WriteStreamHeader(*poolConn.Conn, header)
+	if err != nil {
+		utils.LogError("Error writing stream header : %v", err)
+		return
+	}
+
+	upstream := newMeteredWriter(nil, r.Session, Upstream)
+	downstream := newMeteredWriter(nil, r.Session, Downstream)
+
+	go func() {
+		defer flow.close()
+		for {
+			datagram, err := ReadDatagram(*poolConn.Conn)
+			if err != nil {
+				return
+			}
+
+			flow.touch()
+			err = downstream.take(len(datagram))
+			if err != nil {
+				return
+			}
+
+			_, err = r.Conn.WriteToUDP(datagram, flow.peer)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-flow.done:
+			return
+		case datagram := <-flow.packets:
+			err := upstream.take(len(datagram))
+			if err != nil {
+				return
+			}
+
+			err = WriteDatagram(*poolConn.Conn, datagram)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (r *UdpRelay) pruneIdleFlows() {
+	ticker := time.NewTicker(MainConfig.UdpIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.Mu.Lock()
+		if r.Flows == nil {
+			r.Mu.Unlock()
+			return
+		}
+
+		for _, flow := range r.Flows {
+			if flow.idleFor() > MainConfig.UdpIdleTimeout {
+				utils.LogDebug("Expiring idle udp flow", slog.String("peer", flow.peer.String()))
+				flow.close()
+			}
+		}
+		r.Mu.Unlock()
+	}
+}
+
+func (r *UdpRelay) closeAllFlows() {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	for _, flow := range r.Flows {
+		flow.close()
+	}
+
+	// tells the pruner the relay is gone
+	r.Flows = nil
+}
+
+func NewUdpRelay(conn *net.UDPConn, session *Session) *UdpRelay {
+	return &UdpRelay{
+		Conn:    conn,
+		Session: session,
+		Flows:   map[string]*udpFlow{},
+	}
+}